@@ -1,13 +1,20 @@
 package cache
 
 import (
+	"sort"
+
 	"github.com/huydoan2/eventual_consistency/vectorclock"
 )
 
 // key-value store cache
 type Value struct {
-	Val   string
-	Clock vectorclock.VectorClock
+	Val     string
+	Clock   vectorclock.VectorClock
+	Deleted bool  // tombstone: the key was deleted at Clock
+	Expires int64 // unix time in ns the value expires at, 0 if it never does
+
+	// Concurrent versions of the key kept next to this one when the store keeps siblings
+	Siblings []Value
 }
 
 type Payload struct {
@@ -15,30 +22,118 @@ type Payload struct {
 	Val     string
 	ValTime vectorclock.VectorClock
 	Clock   vectorclock.VectorClock // current clock of the process
-}
+	Deleted bool                    // the entry is a tombstone
+	Expires int64                   // unix time in ns the value expires at, 0 if it never does
+
+	// Concurrent versions of the key, and the join of all their clocks. A write whose
+	// clock dominates the context replaces every sibling
+	Siblings []Value
+	Context  vectorclock.VectorClock
 
-// Cache class
-type Cache struct {
-	Data map[string]Value
+	// Session dependencies of the request: the server must have seen them before serving it
+	Deps vectorclock.VectorClock
+
+	// Version number of the server that replied, the number of stabilize rounds it applied,
+	// and the join of the clocks of the writes those rounds spread
+	Version int64
+	Stable  vectorclock.VectorClock
+
+	// Clock of the version of the key a conditional put expects, the one the client read
+	Expected vectorclock.VectorClock
 }
 
-// New initialize a new cache
-func New() *Cache {
-	c := new(Cache)
-	c.Data = make(map[string]Value)
-	return c
+// Versions returns the value and its siblings as a list of single versions
+func (v *Value) Versions() []Value {
+	out := make([]Value, 0, len(v.Siblings)+1)
+	out = append(out, Value{Val: v.Val, Clock: v.Clock, Deleted: v.Deleted, Expires: v.Expires})
+	for _, sib := range v.Siblings {
+		out = append(out, sib.Versions()...)
+	}
+	return out
 }
 
-func (c *Cache) Invalidate() {
-	c.Data = make(map[string]Value)
+// Expire returns the value with the versions whose time to live is over at now turned into
+// tombstones of the same clock, and whether there was any. Unlike a missing key, the
+// tombstone still wins over the older versions of the key, so a replica that missed the
+// write cannot bring an older version back
+func (v Value) Expire(now int64) (Value, bool) {
+	expired := false
+	if !v.Deleted && v.Expires != 0 && v.Expires <= now {
+		v.Val, v.Deleted, v.Expires = "", true, 0
+		expired = true
+	}
+	if len(v.Siblings) != 0 {
+		siblings := make([]Value, len(v.Siblings))
+		for i, sib := range v.Siblings {
+			var e bool
+			siblings[i], e = sib.Expire(now)
+			expired = expired || e
+		}
+		v.Siblings = siblings
+	}
+	return v, expired
 }
 
-func (c *Cache) Insert(p *Payload) {
+// Context returns the join of the clocks of the value and its siblings
+func (v *Value) Context() vectorclock.VectorClock {
+	ctx := v.Clock.Copy()
+	for _, sib := range v.Siblings {
+		ctx.Update(&sib.Clock)
+	}
+	return ctx
+}
 
-	c.Data[p.Key] = Value{p.Val, p.ValTime}
+// Equal returns true if both values hold the same versions
+func (v *Value) Equal(other *Value) bool {
+	if v.Val != other.Val || v.Deleted != other.Deleted || v.Expires != other.Expires || !v.Clock.Equal(&other.Clock) ||
+		len(v.Siblings) != len(other.Siblings) {
+		return false
+	}
+	for i := range v.Siblings {
+		if !v.Siblings[i].Equal(&other.Siblings[i]) {
+			return false
+		}
+	}
+	return true
 }
 
-func (c *Cache) Find(key *string) (Value, bool) {
-	v, ok := c.Data[*key]
-	return v, ok
+// MergeSiblings returns the value holding every version of a and b that no other version
+// causally dominates. The greatest version in the total order of the vector clocks is the
+// value itself and the others are its siblings, so every replica merges to the same value
+func MergeSiblings(a, b Value) Value {
+	all := append(a.Versions(), b.Versions()...)
+
+	keep := make([]Value, 0, len(all))
+	for i, x := range all {
+		dominated := false
+		for j, y := range all {
+			if i == j {
+				continue
+			}
+			if x.Clock.Time.Equal(&y.Clock.Time) {
+				// Same version seen twice, keep the first one
+				if j < i {
+					dominated = true
+					break
+				}
+				continue
+			}
+			if x.Clock.Time.Compare(&y.Clock.Time) == vectorclock.LESS {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			keep = append(keep, x)
+		}
+	}
+
+	sort.Slice(keep, func(i, j int) bool {
+		return keep[i].Clock.Compare(&keep[j].Clock) == vectorclock.GREATER
+	})
+	out := keep[0]
+	if len(keep) > 1 {
+		out.Siblings = keep[1:]
+	}
+	return out
 }
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+func version(val string, owner int64, time map[int64]int64) Value {
+	return Value{Val: val, Clock: vectorclock.VectorClock{Time: vectorclock.TimeStamp{Time: time}, Id: owner}}
+}
+
+// vals returns the value of v followed by the values of its siblings
+func vals(v Value) []string {
+	out := []string{v.Val}
+	for _, sib := range v.Siblings {
+		out = append(out, sib.Val)
+	}
+	return out
+}
+
+func TestMergeSiblings(t *testing.T) {
+	a1 := version("a1", 1, map[int64]int64{1: 1})
+	a2 := version("a2", 1, map[int64]int64{1: 2})
+	b1 := version("b1", 2, map[int64]int64{2: 1})
+	c1 := version("c1", 3, map[int64]int64{3: 1})
+	ab := version("ab", 1, map[int64]int64{1: 3, 2: 1})
+	withSib := a2
+	withSib.Siblings = []Value{b1}
+
+	tests := []struct {
+		name string
+		a, b Value
+		want []string
+	}{
+		{"newer replaces older", a1, a2, []string{"a2"}},
+		{"older does not replace newer", a2, a1, []string{"a2"}},
+		{"concurrent kept as siblings", a1, b1, []string{"b1", "a1"}},
+		{"order does not depend on the side", b1, a1, []string{"b1", "a1"}},
+		{"same version once", a1, a1, []string{"a1"}},
+		{"new concurrent sibling", withSib, c1, []string{"c1", "b1", "a2"}},
+		{"write dominating the context replaces every sibling", withSib, ab, []string{"ab"}},
+		{"dominated sibling dropped", withSib, a1, []string{"b1", "a2"}},
+	}
+	for _, tt := range tests {
+		got := vals(MergeSiblings(tt.a, tt.b))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: MergeSiblings = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: MergeSiblings = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	v := version("a", 1, map[int64]int64{1: 2})
+	v.Siblings = []Value{version("b", 2, map[int64]int64{1: 1, 2: 3})}
+	ctx := v.Context()
+	want := vectorclock.TimeStamp{Time: map[int64]int64{1: 2, 2: 3}}
+	if !ctx.Time.Equal(&want) {
+		t.Errorf("Context = %s, want 1:2, 2:3", ctx.ToString())
+	}
+	if v.Clock.Time.Time[2] != 0 {
+		t.Errorf("Context changed the clock of the value: %s", v.Clock.ToString())
+	}
+}
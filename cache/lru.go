@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Stats : counters of an LRU cache
+type Stats struct {
+	Entries, Pinned, Capacity int
+	Hits, Misses, Evictions   int64
+}
+
+type lruEntry struct {
+	key     string
+	val     Value
+	server  int64 // server the value was last seen at, -1 if unknown
+	version int64 // version number of that server at the time
+	pinned  bool
+}
+
+// LRU : cache holding at most Capacity entries, evicting the least recently used one first.
+// Pinned entries are never evicted, so a full cache of pinned entries grows past Capacity.
+// A Capacity of 0 never evicts. A value whose time to live is over is returned as a
+// tombstone. It is safe for concurrent use
+type LRU struct {
+	Capacity int
+	mu       sync.Mutex
+	stats    Stats
+	entries  map[string]*list.Element
+	order    *list.List // front is the most recently used
+}
+
+// NewLRU initialize a new LRU cache
+func NewLRU(capacity int) *LRU {
+	c := new(LRU)
+	c.Capacity = capacity
+	c.entries = make(map[string]*list.Element)
+	c.order = list.New()
+	return c
+}
+
+// Invalidate drops every entry, pinned ones too
+func (c *LRU) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Insert caches p as seen at server with its version number. A pinned entry stays in the
+// cache until it is covered, see DropCovered
+func (c *LRU) Insert(p *Payload, server, version int64, pinned bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &lruEntry{key: p.Key, val: Value{p.Val, p.ValTime, p.Deleted, p.Expires, p.Siblings}, server: server, version: version, pinned: pinned}
+	if el, ok := c.entries[p.Key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+	} else {
+		c.entries[p.Key] = c.order.PushFront(e)
+	}
+
+	// Evict from the least recently used end, never the entry just inserted
+	for el := c.order.Back(); c.Capacity > 0 && len(c.entries) > c.Capacity && el != c.order.Front(); {
+		prev := el.Prev()
+		if e := el.Value.(*lruEntry); !e.pinned {
+			c.order.Remove(el)
+			delete(c.entries, e.key)
+			c.stats.Evictions++
+		}
+		el = prev
+	}
+}
+
+// Find returns the cached value of key and marks it as recently used. It counts a hit or a miss
+func (c *LRU) Find(key *string) (Value, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[*key]
+	if !ok {
+		c.stats.Misses++
+		return Value{}, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(el)
+	val, _ := el.Value.(*lruEntry).val.Expire(time.Now().UnixNano())
+	return val, true
+}
+
+// Peek returns the cached value of key without counting or marking it as used
+func (c *LRU) Peek(key *string) (Value, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[*key]
+	if !ok {
+		return Value{}, false
+	}
+	val, _ := el.Value.(*lruEntry).val.Expire(time.Now().UnixNano())
+	return val, true
+}
+
+// Range returns the cached values of the keys from start up to but not including end, an
+// empty end having no bound. They are not counted or marked as used
+func (c *LRU) Range(start, end string) map[string]Value {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UnixNano()
+	out := make(map[string]Value)
+	for k, el := range c.entries {
+		if k >= start && (end == "" || k < end) {
+			out[k], _ = el.Value.(*lruEntry).val.Expire(now)
+		}
+	}
+	return out
+}
+
+// DropCovered drops the entries that a newer stabilized state covers: the ones seen at a
+// server whose version number is now greater than when they were seen, and whose clock the
+// stable clock of that server covers. The servers hold them now, so the cache no longer
+// needs them for read-your-writes. A round that did not gather an entry raises the version
+// but not the clock, and the entry stays. Returns how many were dropped
+func (c *LRU) DropCovered(versions map[int64]int64, stable map[int64]vectorclock.VectorClock) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*lruEntry)
+		if v, ok := versions[e.server]; ok && e.server >= 0 && v > e.version && e.coveredBy(stable[e.server]) {
+			c.order.Remove(el)
+			delete(c.entries, e.key)
+			dropped++
+		}
+		el = next
+	}
+	return dropped
+}
+
+// coveredBy tells if clock covers the version of the entry and its siblings
+func (e *lruEntry) coveredBy(clock vectorclock.VectorClock) bool {
+	ctx := e.val.Context()
+	return ctx.Time.Compare(&clock.Time) == vectorclock.LESS
+}
+
+// Stats returns the counters of the cache
+func (c *LRU) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	s.Capacity = c.Capacity
+	for _, el := range c.entries {
+		if el.Value.(*lruEntry).pinned {
+			s.Pinned++
+		}
+	}
+	return s
+}
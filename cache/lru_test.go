@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+func insert(c *LRU, key string, server, version int64, pinned bool) {
+	c.Insert(&Payload{Key: key, Val: key}, server, version, pinned)
+}
+
+// cached returns the keys in the cache, in ascending order
+func cached(c *LRU) []string {
+	var out []string
+	for k := range c.Range("", "") {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLRUEviction(t *testing.T) {
+	type op struct {
+		find   string // key to look up before inserting, if any
+		key    string
+		pinned bool
+	}
+	tests := []struct {
+		name     string
+		capacity int
+		ops      []op
+		want     []string
+	}{
+		{"under capacity", 3, []op{{key: "a"}, {key: "b"}}, []string{"a", "b"}},
+		{"least recently inserted goes", 2, []op{{key: "a"}, {key: "b"}, {key: "c"}}, []string{"b", "c"}},
+		{"find keeps an entry", 2, []op{{key: "a"}, {key: "b"}, {find: "a", key: "c"}}, []string{"a", "c"}},
+		{"insert again keeps an entry", 2, []op{{key: "a"}, {key: "b"}, {key: "a"}, {key: "c"}}, []string{"a", "c"}},
+		{"pinned never evicted", 2, []op{{key: "a", pinned: true}, {key: "b"}, {key: "c"}}, []string{"a", "c"}},
+		{"pinned grow past capacity", 1, []op{{key: "a", pinned: true}, {key: "b", pinned: true}}, []string{"a", "b"}},
+		{"newest stays when the rest is pinned", 1, []op{{key: "a", pinned: true}, {key: "b"}}, []string{"a", "b"}},
+		{"newest evicted next", 1, []op{{key: "a", pinned: true}, {key: "b"}, {key: "c"}}, []string{"a", "c"}},
+		{"unpinned by a new insert", 1, []op{{key: "a", pinned: true}, {key: "a"}, {key: "b"}}, []string{"b"}},
+		{"no capacity never evicts", 0, []op{{key: "a"}, {key: "b"}, {key: "c"}}, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		c := NewLRU(tt.capacity)
+		for _, o := range tt.ops {
+			if o.find != "" {
+				c.Find(&o.find)
+			}
+			insert(c, o.key, 1, 0, o.pinned)
+		}
+		if got := cached(c); !equalKeys(got, tt.want) {
+			t.Errorf("%s: cache holds %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLRUPeekDoesNotCount(t *testing.T) {
+	c := NewLRU(2)
+	insert(c, "a", 1, 0, false)
+	insert(c, "b", 1, 0, false)
+	key := "a"
+	if _, ok := c.Peek(&key); !ok {
+		t.Fatalf("Peek(a) missed")
+	}
+	insert(c, "c", 1, 0, false)
+	if got := cached(c); !equalKeys(got, []string{"b", "c"}) {
+		t.Errorf("cache holds %v after Peek, want [b c]", got)
+	}
+	if s := c.Stats(); s.Hits != 0 || s.Misses != 0 || s.Evictions != 1 {
+		t.Errorf("Stats = %+v, want no hit, no miss and 1 eviction", s)
+	}
+}
+
+func TestLRUStats(t *testing.T) {
+	c := NewLRU(2)
+	insert(c, "a", 1, 0, true)
+	insert(c, "b", 1, 0, false)
+	a, z := "a", "z"
+	c.Find(&a)
+	c.Find(&z)
+	s := c.Stats()
+	want := Stats{Entries: 2, Pinned: 1, Capacity: 2, Hits: 1, Misses: 1}
+	if s != want {
+		t.Errorf("Stats = %+v, want %+v", s, want)
+	}
+}
+
+func TestLRUExpired(t *testing.T) {
+	c := NewLRU(0)
+	c.Insert(&Payload{Key: "a", Val: "1", Expires: time.Now().Add(-time.Second).UnixNano()}, 1, 0, false)
+	key := "a"
+	v, ok := c.Find(&key)
+	if !ok || !v.Deleted || v.Val != "" {
+		t.Errorf("Find of an expired value = %+v, %t, want a tombstone", v, ok)
+	}
+}
+
+// stableAt returns stable clocks that cover the writes of process 7 up to t on every server
+func stableAt(t int64, servers ...int64) map[int64]vectorclock.VectorClock {
+	out := make(map[int64]vectorclock.VectorClock)
+	for _, s := range servers {
+		out[s] = vectorclock.VectorClock{Time: vectorclock.TimeStamp{Time: map[int64]int64{7: t}}}
+	}
+	return out
+}
+
+func TestLRUDropCovered(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions map[int64]int64
+		stable   map[int64]vectorclock.VectorClock
+		want     []string
+	}{
+		{"no stabilize yet", map[int64]int64{1: 3, 2: 5}, stableAt(9, 1, 2), []string{"a", "b", "c", "d"}},
+		{"server 1 stabilized", map[int64]int64{1: 4}, stableAt(9, 1), []string{"b", "c", "d"}},
+		{"both stabilized", map[int64]int64{1: 4, 2: 6}, stableAt(9, 1, 2), []string{"c", "d"}},
+		{"unknown server kept", map[int64]int64{1: 4, 2: 6, -1: 9}, stableAt(9, 1, 2, -1), []string{"c", "d"}},
+		{"other servers only", map[int64]int64{3: 9}, stableAt(9, 3), []string{"a", "b", "c", "d"}},
+		{"round did not gather the writes", map[int64]int64{1: 4, 2: 6}, nil, []string{"a", "b", "c", "d"}},
+		{"round gathered older writes only", map[int64]int64{1: 4, 2: 6}, stableAt(1, 1, 2), []string{"b", "c", "d"}},
+		{"every write gathered", map[int64]int64{1: 4, 2: 6}, stableAt(2, 1, 2), []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		c := NewLRU(0)
+		c.Insert(&Payload{Key: "a", Val: "a", ValTime: stableAt(1, 0)[0]}, 1, 3, true)
+		c.Insert(&Payload{Key: "b", Val: "b", ValTime: stableAt(2, 0)[0]}, 2, 5, false)
+		insert(c, "c", -1, 0, true)
+		insert(c, "d", 3, 9, false)
+		dropped := c.DropCovered(tt.versions, tt.stable)
+		got := cached(c)
+		if !equalKeys(got, tt.want) {
+			t.Errorf("%s: cache holds %v, want %v", tt.name, got, tt.want)
+		}
+		if dropped != 4-len(tt.want) {
+			t.Errorf("%s: DropCovered = %d, want %d", tt.name, dropped, 4-len(tt.want))
+		}
+	}
+}
+
+func TestLRUInvalidate(t *testing.T) {
+	c := NewLRU(2)
+	insert(c, "a", 1, 0, true)
+	insert(c, "b", 1, 0, false)
+	c.Invalidate()
+	if got := cached(c); len(got) != 0 {
+		t.Errorf("cache holds %v after Invalidate", got)
+	}
+}
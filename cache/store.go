@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Number of shards of a Store. Keys in different shards never wait on each other
+const Shards = 16
+
+type shard struct {
+	mu sync.RWMutex
+	m  map[string]Value
+}
+
+// Store : key-value store that is safe for concurrent use. Keys are spread over Shards
+// maps by their hash, each guarded by its own RW lock. A sorted index of the keys serves
+// range scans
+type Store struct {
+	shards [Shards]*shard
+
+	// Taken after the lock of a shard, never before
+	index sync.RWMutex
+	keys  []string // every key in ascending order
+}
+
+// Resolver returns the value to keep for a key that has the two versions cur and next, and
+// whether it differs from cur
+type Resolver func(cur, next Value) (Value, bool)
+
+// NewStore initialize a new empty store
+func NewStore() *Store {
+	s := new(Store)
+	for i := range s.shards {
+		s.shards[i] = &shard{m: make(map[string]Value)}
+	}
+	return s
+}
+
+func (s *Store) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%Shards]
+}
+
+// indexAdd adds a new key to the index. Caller holds the lock of its shard
+func (s *Store) indexAdd(key string) {
+	s.index.Lock()
+	defer s.index.Unlock()
+	i := sort.SearchStrings(s.keys, key)
+	if i < len(s.keys) && s.keys[i] == key {
+		return
+	}
+	s.keys = append(s.keys, "")
+	copy(s.keys[i+1:], s.keys[i:])
+	s.keys[i] = key
+}
+
+// indexRemove removes a key from the index. Caller holds the lock of its shard
+func (s *Store) indexRemove(key string) {
+	s.index.Lock()
+	defer s.index.Unlock()
+	i := sort.SearchStrings(s.keys, key)
+	if i < len(s.keys) && s.keys[i] == key {
+		s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	}
+}
+
+// Get returns the value of key
+func (s *Store) Get(key string) (Value, bool) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	v, ok := sh.m[key]
+	return v, ok
+}
+
+// Set stores v as the value of key, whatever the value it replaces
+func (s *Store) Set(key string, v Value) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.m[key]; !ok {
+		s.indexAdd(key)
+	}
+	sh.m[key] = v
+}
+
+// Delete removes key
+func (s *Store) Delete(key string) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.m[key]; ok {
+		delete(sh.m, key)
+		s.indexRemove(key)
+	}
+}
+
+// DeleteIf removes key if its value satisfies cond, atomically. Returns true if it was removed
+func (s *Store) DeleteIf(key string, cond func(v Value) bool) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if v, ok := sh.m[key]; ok && cond(v) {
+		delete(sh.m, key)
+		s.indexRemove(key)
+		return true
+	}
+	return false
+}
+
+// Merge atomically compares next with the value of key and stores the value resolve keeps.
+// A missing key takes next. Returns the value of key afterwards and whether it changed
+func (s *Store) Merge(key string, next Value, resolve Resolver) (Value, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	cur, ok := sh.m[key]
+	if !ok {
+		sh.m[key] = next
+		s.indexAdd(key)
+		return next, true
+	}
+	merged, changed := resolve(cur, next)
+	if changed {
+		sh.m[key] = merged
+	}
+	return merged, changed
+}
+
+// Newer is the Resolver that keeps the greater version in the total order of the vector
+// clocks, concurrent versions being ordered by the id of their clocks
+func Newer(cur, next Value) (Value, bool) {
+	if cur.Clock.Compare(&next.Clock) == vectorclock.LESS && !cur.Clock.Equal(&next.Clock) {
+		return next, true
+	}
+	return cur, false
+}
+
+// Len returns the number of keys
+func (s *Store) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// Range calls f on every key and value until it returns false. Each shard is read locked
+// while it is visited, so f must not write to the store
+func (s *Store) Range(f func(key string, v Value) bool) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for k, v := range sh.m {
+			if !f(k, v) {
+				sh.mu.RUnlock()
+				return
+			}
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// Snapshot returns a copy of the store as a map
+func (s *Store) Snapshot() map[string]Value {
+	out := make(map[string]Value)
+	s.Range(func(k string, v Value) bool {
+		out[k] = v
+		return true
+	})
+	return out
+}
+
+// Keys returns the keys from start up to but not including end in ascending order, at most
+// limit of them. An empty end has no bound and a limit of 0 no limit
+func (s *Store) Keys(start, end string, limit int) []string {
+	s.index.RLock()
+	defer s.index.RUnlock()
+	var out []string
+	for i := sort.SearchStrings(s.keys, start); i < len(s.keys); i++ {
+		if (end != "" && s.keys[i] >= end) || (limit > 0 && len(out) == limit) {
+			break
+		}
+		out = append(out, s.keys[i])
+	}
+	return out
+}
+
+// Clear removes every key
+func (s *Store) Clear() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		sh.m = make(map[string]Value)
+	}
+	s.index.Lock()
+	s.keys = nil
+	s.index.Unlock()
+}
+
+// Load replaces the content of the store with m
+func (s *Store) Load(m map[string]Value) {
+	s.Clear()
+	for k, v := range m {
+		s.Set(k, v)
+	}
+}
@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// at returns a version of key written by process owner at time t
+func at(key string, owner, t int64) Value {
+	return Value{Val: key, Clock: vectorclock.VectorClock{Time: vectorclock.TimeStamp{Time: map[int64]int64{owner: t}}, Id: owner}}
+}
+
+// Run with -race: writers merge, delete and range over the same keys in parallel
+func TestStoreConcurrent(t *testing.T) {
+	const writers, keys, rounds = 8, 50, 20
+	s := NewStore()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 1; r <= rounds; r++ {
+				for k := 0; k < keys; k++ {
+					key := "k" + strconv.Itoa(k)
+					s.Merge(key, at(key, 0, int64(r)), Newer)
+					if k%10 == w {
+						// Only removes an old version, never the last one
+						s.DeleteIf(key, func(v Value) bool { return v.Clock.Time.Time[0] < int64(r)-5 })
+					}
+				}
+				s.Keys("k1", "k5", 10)
+				s.Snapshot()
+				s.Len()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	snap := s.Snapshot()
+	for k, v := range snap {
+		if v.Clock.Time.Time[0] != rounds {
+			t.Errorf("%s ended at %s, want the last round", k, v.Clock.ToString())
+		}
+	}
+	checkIndex(t, s)
+}
+
+// Run with -race: keys are added and removed while others scan them
+func TestStoreConcurrentIndex(t *testing.T) {
+	s := NewStore()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := "k" + strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				s.Set(key, at(key, int64(w), 1))
+				if i%2 == 0 {
+					s.Delete(key)
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				keys := s.Keys("", "", 0)
+				if !sort.StringsAreSorted(keys) {
+					t.Errorf("Keys are not sorted: %v", keys)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := s.Len(); n != 400 {
+		t.Errorf("Len = %d, want 400", n)
+	}
+	checkIndex(t, s)
+}
+
+// checkIndex fails if the index of s does not list exactly the keys of its shards
+func checkIndex(t *testing.T, s *Store) {
+	var want []string
+	for k := range s.Snapshot() {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	got := s.Keys("", "", 0)
+	if len(got) != len(want) {
+		t.Fatalf("index has %d keys, store has %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("index has %s where the store has %s", got[i], want[i])
+		}
+	}
+}
+
+// Run with -race: the client inserts, finds and drops entries from several requests at once
+func TestLRUConcurrent(t *testing.T) {
+	c := NewLRU(20)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := "k" + strconv.Itoa(i%40)
+				c.Insert(&Payload{Key: key, Val: key}, int64(w), int64(i), i%7 == 0)
+				c.Find(&key)
+				c.Peek(&key)
+				if i%50 == 0 {
+					c.DropCovered(map[int64]int64{int64(w): int64(i)}, nil)
+					c.Range("k1", "k3")
+					c.Stats()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	st := c.Stats()
+	if st.Entries-st.Pinned > c.Capacity {
+		t.Errorf("%d unpinned entries in a cache of capacity %d", st.Entries-st.Pinned, c.Capacity)
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	s := NewStore()
+	for _, k := range []string{"d", "a", "c", "b", "e", "aa"} {
+		s.Set(k, at(k, 1, 1))
+	}
+	s.Delete("c")
+
+	tests := []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 0, []string{"a", "aa", "b", "d", "e"}},
+		{"b", "", 0, []string{"b", "d", "e"}},
+		{"", "b", 0, []string{"a", "aa"}},
+		{"aa", "d", 0, []string{"aa", "b"}},
+		{"c", "d", 0, nil},
+		{"ab", "", 0, []string{"b", "d", "e"}},
+		{"", "", 2, []string{"a", "aa"}},
+		{"b", "", 5, []string{"b", "d", "e"}},
+		{"f", "", 0, nil},
+		{"d", "b", 0, nil},
+	}
+	for _, tt := range tests {
+		got := s.Keys(tt.start, tt.end, tt.limit)
+		if !equalKeys(got, tt.want) {
+			t.Errorf("Keys(%q, %q, %d) = %v, want %v", tt.start, tt.end, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestStoreKeysAfterChanges(t *testing.T) {
+	s := NewStore()
+	s.Merge("b", at("b", 1, 1), Newer)
+	s.Merge("a", at("a", 1, 1), Newer)
+	s.Merge("a", at("a", 1, 2), Newer)
+	s.DeleteIf("b", func(v Value) bool { return false })
+	if got := s.Keys("", "", 0); !equalKeys(got, []string{"a", "b"}) {
+		t.Errorf("Keys = %v, want [a b]", got)
+	}
+	s.DeleteIf("b", func(v Value) bool { return true })
+	if got := s.Keys("", "", 0); !equalKeys(got, []string{"a"}) {
+		t.Errorf("Keys after DeleteIf = %v, want [a]", got)
+	}
+	s.Load(map[string]Value{"z": at("z", 1, 1), "y": at("y", 1, 1)})
+	if got := s.Keys("", "", 0); !equalKeys(got, []string{"y", "z"}) {
+		t.Errorf("Keys after Load = %v, want [y z]", got)
+	}
+	s.Clear()
+	if got := s.Keys("", "", 0); len(got) != 0 {
+		t.Errorf("Keys after Clear = %v, want none", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// BatchData : RPC type for a batch of puts through the client, Values[i] being the value of
+// Keys[i]. W and TTL are the ones of a put and apply to every key
+type BatchData struct {
+	Keys, Values []string
+	W            string
+	TTL          time.Duration
+}
+
+// BatchArgs : RPC type for ServerService.PutBatch
+type BatchArgs struct {
+	Values map[string]cache.Value
+	Clock  vectorclock.VectorClock
+	Deps   vectorclock.VectorClock
+}
+
+// PutBatch: RPC to put many keys at once under one vector clock timestamp. A server applies
+// the batch atomically. Without a consistency level it goes to a single server, retried on
+// the others like a get; with one it goes to every connected replica of any of its keys and
+// waits for the level out of all of them. A batch is never handed off
+func (cs *ClientService) PutBatch(arg *BatchData, reply *RequestReply) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	debug(id, fmt.Sprintf("Putting a batch of %d key(s) ...", len(arg.Keys)))
+
+	if len(arg.Keys) == 0 || len(arg.Keys) != len(arg.Values) {
+		return errors.New("A batch needs as many values as keys, and at least one")
+	}
+	for i, k := range arg.Keys {
+		for _, other := range arg.Keys[:i] {
+			if k == other {
+				return fmt.Errorf("Key %s is written twice by the batch", k)
+			}
+		}
+	}
+	if len(RPCclients) == 0 {
+		return errNoServer
+	}
+
+	level := arg.W
+	if level == "" {
+		level = writeLevel
+	}
+	servers := make(map[int64]*rpc.Client)
+	need := 1
+	serverID, server := chooseServer(arg.Keys[0])
+	if level == "" {
+		servers[serverID] = server
+	} else {
+		for _, k := range arg.Keys {
+			for s, server := range replicaSet(k) {
+				servers[s] = server
+			}
+		}
+		if len(servers) == 0 {
+			return errNoServer
+		}
+		var err error
+		if need, err = quorum(level, len(servers)); err != nil {
+			return err
+		}
+	}
+
+	// One timestamp for the whole batch
+	for _, k := range arg.Keys {
+		if val, ok := cCache.Peek(&k); ok && len(val.Siblings) != 0 {
+			vClock.Update(&val.Clock)
+		}
+	}
+	vClock.Increment(id)
+	batch := BatchArgs{Values: make(map[string]cache.Value), Clock: vClock.Copy(), Deps: writeDeps()}
+	expires := expiry(arg.TTL)
+	for i, k := range arg.Keys {
+		batch.Values[k] = cache.Value{Val: arg.Values[i], Clock: batch.Clock, Expires: expires}
+	}
+
+	replies, failed, err := fanOut(servers, "ServerService.PutBatch", &batch, need)
+	checkFailed(failed)
+	if err != nil && level == "" {
+		var resp cache.Payload
+		s, retryErr := withRetry(arg.Keys[0], map[int64]bool{serverID: true}, nil, func(s int64, server *rpc.Client) error {
+			resp = cache.Payload{}
+			return server.Call("ServerService.PutBatch", &batch, &resp)
+		})
+		if retryErr == nil {
+			replies[s] = resp
+			err = nil
+		}
+	}
+	if err != nil {
+		debug(id, err.Error())
+		return err
+	}
+	reply.Servers = servedBy(replies)
+	writeClock.Update(&batch.Clock)
+
+	for s, serverResp := range replies {
+		learnVersion(s, serverResp.Version, &serverResp.Stable)
+		vClock.Update(&serverResp.Clock)
+	}
+	// Keep the writes in the cache until a stabilize on the server that took them covers them
+	s := reply.Servers[0]
+	for k, v := range batch.Values {
+		p := cache.Payload{Key: k, Val: v.Val, ValTime: batch.Clock, Expires: v.Expires}
+		cCache.Insert(&p, s, replies[s].Version, true)
+		rememberVersion(k)
+	}
+	return nil
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/ring"
 	"github.com/huydoan2/eventual_consistency/vectorclock"
 )
 
@@ -27,9 +31,29 @@ var idStr string
 var RPCclients = make(map[int64]*rpc.Client) //store client struct for each connection
 var RPCserver *rpc.Server
 
-var cCache *cache.Cache            // Client cache
+var cCache *cache.LRU              // Client cache
 var vClock vectorclock.VectorClock // local vector clock
 var versionNumber int64
+var serverVersions = make(map[int64]int64)                 // latest version number seen of each server
+var serverStable = make(map[int64]vectorclock.VectorClock) // stable clock seen with it
+
+// Options given on the command line
+var replicas int          // number of servers that store a key, 0 for every server
+var writeLevel string     // default consistency level of puts and deletes
+var readLevel string      // default consistency level of gets
+var retries int           // number of times a failed request is retried on another server
+var backoff time.Duration // wait before the first retry, doubled before each next one
+var selector Selector     // policy choosing the server of a request
+var cacheSize int         // capacity of the cache, 0 for unbounded
+
+// Held by every RPC of ClientService, so requests of the master run one at a time over the
+// connections, clocks and hints of the client. A request waiting to retry releases it
+var lockClient sync.Mutex
+
+var errNoServer = errors.New("Client does not connect to any servers")
+
+// Consistent-hash ring of the servers, as the servers and master tell it
+var keyRing = ring.New(nil)
 
 /*
 	RPC
@@ -38,13 +62,32 @@ var versionNumber int64
 // ClientService : RPC type for client services
 type ClientService int //temporary type
 
+// PutData : argument of Put. W is the consistency level of the write, the client's default if empty
 type PutData struct {
 	Key, Value string
+	W          string
+	TTL        time.Duration // time to live of the value, 0 if it never expires
+}
+
+// RequestReply : reply of Put, Delete and Get. Val is the value read by a Get and Servers
+// are the servers that served the request, after any retries
+type RequestReply struct {
+	Val     string
+	Servers []int64
+}
+
+// GetData : argument of Get. R is the consistency level of the read, the client's default if empty
+type GetData struct {
+	Key string
+	R   string
 }
 
 // BreakConnection : RPC to break connection between client and server with id
-//					: Reply 0 if conn existed and closed, 1 if never existed
+//
+//	: Reply 0 if conn existed and closed, 1 if never existed
 func (cs *ClientService) BreakConnection(serverID *int64, reply *int64) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
 	debug(id, fmt.Sprintf("Breaking connection to Server[%d]...", *serverID))
 
 	if client, ok := RPCclients[*serverID]; ok {
@@ -60,20 +103,24 @@ func (cs *ClientService) BreakConnection(serverID *int64, reply *int64) error {
 }
 
 // CreateConnection : RPC to create connection between client and server with id
-//					: Reply 0 if conn existed and created, 1 if never existed
+//
+//	: Reply 0 if conn existed and created, 1 if never existed
 func (cs *ClientService) CreateConnection(serverID *int64, reply *int64) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
 	if _, ok := RPCclients[*serverID]; !ok {
-		serverPort := strconv.FormatInt(baseServerPort+(*serverID), 10)
-		client, err := rpc.Dial("tcp", "localhost:"+serverPort)
-		if err == nil {
-			RPCclients[*serverID] = client
-			debug(id, fmt.Sprintf("Finished joining client[%d] to server[%d]\n", id, *serverID))
-		} else {
+		// The handshake is done once dialServer returns, the server refuses clients it was
+		// cut off from
+		client, err := dialServer(*serverID)
+		if err != nil {
 			debug(id, err.Error())
-			panic(err)
+			return err
 		}
-		debug(id, fmt.Sprintf("Connection to server[%d] is created successfully", *serverID))
 		RPCclients[*serverID] = client
+		debug(id, fmt.Sprintf("Connection to server[%d] is created successfully", *serverID))
+		learnMembers(client)
+		deliverHints(*serverID, client)
+		subscribeWatches(*serverID, client)
 		*reply = 0
 	} else {
 		debug(id, fmt.Sprintf("Tried to create connection to server[%d] but was already created", *serverID))
@@ -83,74 +130,172 @@ func (cs *ClientService) CreateConnection(serverID *int64, reply *int64) error {
 }
 
 // Put: RPC to put key:value to a server
-func (cs *ClientService) Put(putData *PutData, reply *int64) error {
+func (cs *ClientService) Put(putData *PutData, reply *RequestReply) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
 
 	debug(id, fmt.Sprintf("Putting %s:%s ...", putData.Key, putData.Value))
 
+	level := putData.W
+	if level == "" {
+		level = writeLevel
+	}
+	return write(putData.Key, putData.Value, expiry(putData.TTL), false, false, level, reply)
+}
+
+// Delete: RPC to delete a key. The servers keep a tombstone until it is stabilized
+func (cs *ClientService) Delete(key *string, reply *RequestReply) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	debug(id, fmt.Sprintf("Deleting %s ...", *key))
+
+	return write(*key, "", 0, true, false, writeLevel, reply)
+}
+
+// write sends a put, or a delete when deleted is set, to a server. With a consistency level
+// it goes to every connected replica of the key and waits for the level to be reached. A
+// conditional put expects the version of the key the client last saw, see PutIf. The value
+// expires at expires, a unix time in ns, unless it is 0.
+// reply is set to the servers that acknowledged the write
+func write(key, value string, expires int64, deleted, conditional bool, level string, reply *RequestReply) error {
+
 	// Check if the client is connected to any server
 	length := len(RPCclients)
 	if length == 0 {
-		return errors.New("Client does not connect to any servers")
+		return errNoServer
 	}
 
-	server := getRandomServer()
-
-	// var serverVersion int64
-	// errVersion := server.Call("ServerService.GetVersionNumber", &id, &serverVersion)
-	// if errVersion != nil {
-	// 	debug(id, fmt.Sprintf("Failed to get version number from server"))
-	// 	return errVersion
-	// }
-
-	// if serverVersion > versionNumber {
-	// 	cCache.Invalidate()
-	// 	versionNumber = serverVersion
-	// }
+	servers := replicaSet(key)
+	need := 1
+	if level == "" {
+		serverID, server := chooseServer(key)
+		servers = map[int64]*rpc.Client{serverID: server}
+	} else {
+		if len(servers) == 0 {
+			return errNoServer
+		}
+		var err error
+		if need, err = quorum(level, len(servers)); err != nil {
+			return err
+		}
+	}
 
 	var data cache.Payload
-	data.Key = putData.Key
-	data.Val = putData.Value
+	data.Key = key
+	data.Val = value
+	data.Deleted = deleted
+	data.Expires = expires
+	if val, ok := cCache.Peek(&key); ok {
+		// The write replaces the versions of the key we read, siblings included, and no other
+		data.Context = val.Context()
+		vClock.Update(&data.Context)
+	}
 	vClock.Increment(id)
-	data.ValTime = vClock
-	data.Clock = vClock
+	data.ValTime = vClock.Copy()
+	data.Clock = vClock.Copy()
+	data.Deps = writeDeps()
+
+	// We have the servers now, put data to them
+	method := "ServerService.Put"
+	if deleted {
+		method = "ServerService.Delete"
+	}
+	if conditional {
+		// A refused put must not be read back, it is only cached once accepted
+		method = "ServerService.PutIf"
+		data.Expected = expectedVersion(key)
+	} else {
+		cCache.Insert(&data, -1, 0, true)
+	}
+	debug(id, fmt.Sprintf("Calling %s RPC on %d server(s), waiting for %d", method, len(servers), need))
+	replies, failed, err := fanOut(servers, method, &data, need)
+	checkFailed(failed)
 
-	cCache.Insert(&data)
+	if conditional {
+		if conflictErr := conflict(failed); err != nil && conflictErr != nil {
+			err = conflictErr
+		}
+		// A stand-in could not check the version of the key, so it is not handed off
+		failed = nil
+	}
 
-	var serverResp cache.Payload
-	// We have a server now, put data to it
-	debug(id, "Calling Put RPC from server")
-	err := server.Call("ServerService.Put", &data, &serverResp) // TODO: need to support if server fails in the middle
+	// Hand the write over to another server for each server that could not take it. A
+	// single server write succeeds through the stand-in, a quorum write only counts replicas
+	for s := range failed {
+		standIn, resp, ok := handoff(s, &data)
+		if ok && level == "" {
+			replies[standIn] = resp
+			err = nil
+		}
+	}
+	reply.Servers = servedBy(replies)
 
 	if err != nil {
+		// No server took the write, keep it in the cache but let it be evicted
+		if !conditional {
+			cCache.Insert(&data, -1, 0, false)
+		}
 		debug(id, err.Error())
 		return err
 	}
+	// A server keeping siblings stores the write at the clock it replies, the one to remember.
+	// The calls to slower replicas may still be sending data, the clock goes to a copy
+	s := reply.Servers[0]
+	stored := data
+	if resp := replies[s]; resp.Key == "" && len(resp.ValTime.Time.Time) != 0 {
+		stored.ValTime = resp.ValTime
+	}
+	writeClock.Update(&stored.ValTime)
+
+	for s, serverResp := range replies {
+		learnVersion(s, serverResp.Version, &serverResp.Stable)
+	}
+	// Keep the write in the cache until a stabilize on the server that took it covers it
+	cCache.Insert(&stored, s, replies[s].Version, true)
 
-	vClock.Update(&serverResp.Clock)
+	for s, serverResp := range replies {
+		vClock.Update(&serverResp.Clock)
 
-	if serverResp.Key != "" {
-		cCache.Insert(&serverResp)
+		if serverResp.Key != "" {
+			cCache.Insert(&serverResp, s, serverResp.Version, false)
+		}
 	}
+	rememberVersion(key)
 
 	return nil
 }
 
-// Get: RPC to querry the value of a key
-func (cs *ClientService) Get(key *string, reply *string) error {
-
-	// If not, query a server for the key
-	server := getRandomServer()
+// Get: RPC to querry the value of a key. With a consistency level the key is read from
+// every connected replica and the newest of the first R responses is kept
+func (cs *ClientService) Get(getData *GetData, getReply *RequestReply) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+	reply := &getReply.Val
+	key := &getData.Key
+	level := getData.R
+	if level == "" {
+		level = readLevel
+	}
 
-	var serverVersion int64
-	errVersion := server.Call("ServerService.GetVersionNumber", &id, &serverVersion)
-	if errVersion != nil {
-		debug(id, fmt.Sprintf("Failed to get version number from server"))
-		return errVersion
+	if len(RPCclients) == 0 {
+		return errNoServer
 	}
 
-	if serverVersion > versionNumber {
-		//cCache.Invalidate()
-		versionNumber = serverVersion
+	// If not, query a server for the key
+	serverID, server := chooseServer(*key)
+	servers := replicaSet(*key)
+	need := 1
+	if level == "" {
+		servers = map[int64]*rpc.Client{serverID: server}
+	} else {
+		if len(servers) == 0 {
+			return errNoServer
+		}
+		var err error
+		if need, err = quorum(level, len(servers)); err != nil {
+			return err
+		}
 	}
 
 	// val, ok := cCache.Find(key)
@@ -162,22 +307,50 @@ func (cs *ClientService) Get(key *string, reply *string) error {
 	// }
 
 	var data cache.Payload
-	arg := cache.Payload{Key: *key, Clock: vClock}
-
-	err := server.Call("ServerService.Get", &arg, &data)
+	arg := cache.Payload{Key: *key, Clock: vClock.Copy(), Deps: readDeps()}
+
+	replies, failed, err := fanOut(servers, "ServerService.Get", &arg, need)
+	checkFailed(failed)
+	if err != nil && level == "" {
+		// A single server read is retried on the other servers
+		var resp cache.Payload
+		s, retryErr := withRetry(*key, map[int64]bool{serverID: true}, nil, func(s int64, server *rpc.Client) error {
+			resp = cache.Payload{}
+			return server.Call("ServerService.Get", &arg, &resp)
+		})
+		if retryErr == nil {
+			replies[s] = resp
+			err = nil
+		}
+	}
 	if err != nil {
 		// Error with RPC call or from the server
 		s := fmt.Sprintf("Failed to communicate with server\nError: %v", err)
 		debug(id, s)
-		// return errors.New(s)
+		return errors.New(s)
+	}
+	getReply.Servers = servedBy(replies)
+	src := getReply.Servers[0]
+
+	// RPC succeeded, sync time and keep the newest response
+	first := true
+	for s, resp := range replies {
+		learnVersion(s, resp.Version, &resp.Stable)
+		vClock.Update(&resp.Clock)
+		if first {
+			data = resp
+			first = false
+		} else {
+			data = mergeResponses(data, resp)
+		}
 	}
 
-	// RPC succeeded, sync time
-	vClock.Update(&data.Clock)
-
-	if data.Val == "ERR_KEY" {
+	// A version that only the cache has is not pushed to servers missing the key: the key
+	// may have been deleted and its tombstone purged since the client cached it
+	fromServer := false
+	if data.Val == "ERR_KEY" && !data.Deleted {
 		if val, ok := cCache.Find(key); ok {
-			*reply = val.Val
+			*reply = cachedVal(val)
 			debug(id, "Server says ERR_KEY, return cached value")
 		} else {
 			*reply = "ERR_KEY"
@@ -186,20 +359,28 @@ func (cs *ClientService) Get(key *string, reply *string) error {
 		if val, ok := cCache.Find(key); ok {
 			// Compare cache and server response
 			if val.Clock.Compare(&data.ValTime) == vectorclock.LESS {
-				cCache.Insert(&data)
-				*reply = data.Val
+				cCache.Insert(&data, src, replies[src].Version, false)
+				*reply = payloadVal(&data)
+				fromServer = true
 				debug(id, "Server has newer value, update cache")
 			} else {
-				*reply = val.Val
+				*reply = cachedVal(val)
 				debug(id, "Server has stale value, return cached value")
 			}
 		} else {
-			cCache.Insert(&data)
-			*reply = data.Val
+			cCache.Insert(&data, src, replies[src].Version, false)
+			*reply = payloadVal(&data)
+			fromServer = true
 			debug(id, "Cache does not have the entry. Return server's response")
 		}
 	}
 
+	if newest, ok := cCache.Peek(key); ok {
+		readRepair(*key, newest, fromServer, replies)
+		readClock.Update(&newest.Clock)
+	}
+	rememberVersion(*key)
+
 	// Check the replied data from the server
 	// if data.Val == "ERR_KEY" {
 
@@ -242,12 +423,68 @@ func (cs *ClientService) Get(key *string, reply *string) error {
 
 // InvalidateCache RPC to invalidate client's cache. Used for testing
 func (cs *ClientService) InvalidateCache(arg *int64, reply *int64) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
 	cCache.Invalidate()
 	return nil
 }
 
+// CacheStats RPC to get the counters of the client's cache
+func (cs *ClientService) CacheStats(arg *int64, reply *cache.Stats) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+	*reply = cCache.Stats()
+	return nil
+}
+
 /*******************************************************/
 
+// learnVersion records the version number and stable clock of a server seen in a reply.
+// When the version grows, the cache entries that a stabilize on that server covered are dropped
+func learnVersion(serverID, version int64, stable *vectorclock.VectorClock) {
+	if version > versionNumber {
+		versionNumber = version
+	}
+	if old, ok := serverVersions[serverID]; ok && version <= old {
+		return
+	}
+	serverVersions[serverID] = version
+	serverStable[serverID] = stable.Copy()
+	if n := cCache.DropCovered(serverVersions, serverStable); n != 0 {
+		debug(id, fmt.Sprintf("Server[%d] is at version %d, dropped %d covered cache entries", serverID, version, n))
+	}
+}
+
+// cachedVal returns the value of a cache entry as seen by Get, ERR_KEY for a tombstone.
+// A key with siblings is shown as the list of its concurrent values: [v1, v2, ...]
+func cachedVal(val cache.Value) string {
+	if val.Deleted {
+		return "ERR_KEY"
+	}
+	if len(val.Siblings) != 0 {
+		vals := []string{val.Val}
+		for _, sib := range val.Siblings {
+			vals = append(vals, sib.Val)
+		}
+		return "[" + strings.Join(vals, ", ") + "]"
+	}
+	return val.Val
+}
+
+// expiry returns the time a value written now with a time to live of ttl expires at, 0 for
+// a value that never expires. Every replica keeps this same time
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// payloadVal returns the value of a server response as seen by Get
+func payloadVal(p *cache.Payload) string {
+	return cachedVal(cache.Value{Val: p.Val, Clock: p.ValTime, Deleted: p.Deleted, Siblings: p.Siblings})
+}
+
 var logger *log.Logger
 
 func InitLogger() {
@@ -276,17 +513,17 @@ func Init(serverId int64) {
 	vClock.Id = id
 
 	// Init Cache
-	cCache = cache.New()
+	cCache = cache.NewLRU(cacheSize)
 
 	// Connect to serverId
 	tmp := fmt.Sprintf("Connecting to Server[%d]", serverId)
 	debug(id, tmp)
 
 	// Connect to server ID
-	serverPort := strconv.FormatInt(baseServerPort+serverId, 10)
-	client, err := rpc.Dial("tcp", "localhost:"+serverPort)
+	client, err := dialServer(serverId)
 	if err == nil {
 		RPCclients[serverId] = client
+		learnMembers(client)
 		debug(id, fmt.Sprintf("Finished joining client[%d] to server[%d]\n", id, serverId))
 	} else {
 		debug(id, err.Error())
@@ -311,25 +548,44 @@ func Init(serverId int64) {
 	debug(id, "Initialization finished!\n")
 }
 
-func getRandomServer() *rpc.Client {
-	length := len(RPCclients)
-	// Get a random position in the server set
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	serverPos := r.Int63n(int64(length))
-	var server *rpc.Client
-	var i int64
-	var serverID int64
-
-	// A bit complex to get a random server
-	for serverID, server = range RPCclients {
-		if i == serverPos {
-			break
-		} else {
-			i++
-		}
+// learnMembers takes the ring of a server as the client's ring. The servers keep it up to
+// date as servers join and leave
+func learnMembers(server *rpc.Client) {
+	var list []int64
+	if err := server.Call("ServerService.Members", &id, &list); err != nil {
+		debug(id, fmt.Sprintf("Failed to get the ring members: %v", err))
+		return
+	}
+	keyRing = ring.New(list)
+}
+
+// Members : RPC from master to set the servers on the ring after a server joined or left
+func (cs *ClientService) Members(list *[]int64, reply *int64) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	debug(id, fmt.Sprintf("Ring members are %v", *list))
+	keyRing = ring.New(*list)
+	return nil
+}
+
+// chooseServer returns the server a request for key goes to, picked by the selection policy
+// among the connected replicas of the key. If the client is connected to none of them, or
+// keys are not partitioned, it picks among all connected servers
+func chooseServer(key string) (int64, *rpc.Client) {
+	set := replicaSet(key)
+	if len(set) == 0 {
+		set = RPCclients
+	}
+	candidates := make([]int64, 0, len(set))
+	for s := range set {
+		candidates = append(candidates, s)
 	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	serverID := selector.Choose(candidates)
 	debug(id, fmt.Sprintf("Chosen server is %d", serverID))
-	return server
+	return serverID, RPCclients[serverID]
 }
 
 func main() {
@@ -339,6 +595,25 @@ func main() {
 
 	serverID, _ := strconv.ParseInt(os.Args[2], 10, 64) // get server id from command line
 
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	flags.IntVar(&replicas, "replicas", 0, "number of servers that store a key, 0 for every server")
+	flags.StringVar(&writeLevel, "w", "", "consistency level of writes: ONE, QUORUM, ALL or a number")
+	flags.StringVar(&readLevel, "r", "", "consistency level of reads: ONE, QUORUM, ALL or a number")
+	flags.IntVar(&retries, "retries", 2, "number of times a failed request is retried on another server")
+	flags.DurationVar(&backoff, "backoff", 100*time.Millisecond, "wait before the first retry, doubled before each next one")
+	policy := flags.String("policy", "random", "server selection policy: random, roundrobin, sticky, latency or version")
+	flags.IntVar(&cacheSize, "cache", 1000, "capacity of the cache, 0 for unbounded")
+	guarantees := flags.String("session", "", "session guarantees enforced by the servers: comma separated ryw, mr, mw, wfr")
+	flags.Parse(os.Args[3:])
+
+	var err error
+	if selector, err = newSelector(*policy); err != nil {
+		panic(err)
+	}
+	if err = parseSession(*guarantees); err != nil {
+		panic(err)
+	}
+
 	Init(serverID)
 
 	for {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Error of a conditional put whose expected version of the key is not the stored one
+const errConflict = "ERR_CONFLICT"
+
+// Clock of the version of each key the client last read or wrote, the version a conditional
+// put of the key expects. A key the client saw missing has no entry
+var seenVersions = make(map[string]vectorclock.VectorClock)
+
+// PutIf: RPC to put key:value only if the servers still store the version of the key the
+// client last read or wrote, or an older one. Reading a missing key makes the put create it
+// only if it is still missing. Fails with an ERR_CONFLICT error otherwise
+func (cs *ClientService) PutIf(putData *PutData, reply *RequestReply) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	debug(id, fmt.Sprintf("Conditionally putting %s:%s ...", putData.Key, putData.Value))
+
+	level := putData.W
+	if level == "" {
+		level = writeLevel
+	}
+	return write(putData.Key, putData.Value, expiry(putData.TTL), false, true, level, reply)
+}
+
+// rememberVersion records the version of key in the cache as the one the client last saw
+func rememberVersion(key string) {
+	if val, ok := cCache.Peek(&key); ok {
+		seenVersions[key] = val.Clock.Copy()
+	} else {
+		delete(seenVersions, key)
+	}
+}
+
+// expectedVersion returns the clock a conditional put of key expects
+func expectedVersion(key string) vectorclock.VectorClock {
+	expected := seenVersions[key]
+	return expected.Copy()
+}
+
+// conflict returns the error of a server that refused a conditional put, if any
+func conflict(failed map[int64]error) error {
+	for s, err := range failed {
+		if strings.HasPrefix(err.Error(), errConflict) {
+			return fmt.Errorf("%s on server[%d]", err.Error(), s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// HintArgs : argument of ServerService.PutHint, a write for the unreachable server For
+type HintArgs struct {
+	For     int64
+	Payload cache.Payload
+}
+
+// Writes no server could take on behalf of an unreachable server, by the id of that server.
+// They are delivered when the client connects to that server again
+var hints = make(map[int64][]cache.Payload)
+
+// handoff gives a write that server failed to take to another connected server, which keeps
+// it as a hint for server. Stand-ins are tried like any retry, but server itself never is:
+// it failed the write already. It returns the stand-in and its reply. If no server takes
+// the write the client keeps the hint itself
+func handoff(server int64, data *cache.Payload) (int64, cache.Payload, bool) {
+	arg := HintArgs{For: server, Payload: *data}
+	var reply cache.Payload
+	standIn, err := withRetry(data.Key, map[int64]bool{}, map[int64]bool{server: true}, func(s int64, client *rpc.Client) error {
+		reply = cache.Payload{}
+		return client.Call("ServerService.PutHint", &arg, &reply)
+	})
+	if err == nil {
+		debug(id, fmt.Sprintf("Server[%d] keeps %s as a hint for server[%d]", standIn, data.Key, server))
+		return standIn, reply, true
+	}
+
+	debug(id, fmt.Sprintf("Keeping %s as a hint for server[%d]", data.Key, server))
+	hint := *data
+	hint.Deps = vectorclock.VectorClock{}
+	hints[server] = append(hints[server], hint)
+	return 0, cache.Payload{}, false
+}
+
+// deliverHints sends the hints the client keeps for server through the new link to it
+func deliverHints(server int64, client *rpc.Client) {
+	pending := hints[server]
+	delete(hints, server)
+
+	for i := range pending {
+		var reply cache.Payload
+		if err := client.Call("ServerService.Put", &pending[i], &reply); err != nil {
+			debug(id, fmt.Sprintf("Failed to deliver hint %s to server[%d]: %v", pending[i].Key, server, err))
+			hints[server] = append(hints[server], pending[i])
+			continue
+		}
+		debug(id, fmt.Sprintf("Delivered hint %s to server[%d]", pending[i].Key, server))
+		vClock.Update(&reply.Clock)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Selector : policy choosing the server a request goes to. Calls are reported back through
+// Observe so that a policy can learn from them. Observe may be called from several goroutines
+type Selector interface {
+	// Choose returns one of candidates, the connected servers in ascending order
+	Choose(candidates []int64) int64
+	// Observe records a call on server that took rtt and failed with err, or succeeded if nil
+	Observe(server int64, rtt time.Duration, err error)
+}
+
+// newSelector returns the selection policy called name
+func newSelector(name string) (Selector, error) {
+	switch name {
+	case "random":
+		return &randomSelector{r: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case "roundrobin":
+		return &roundRobinSelector{}, nil
+	case "sticky":
+		return &stickySelector{r: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case "latency":
+		return &latencySelector{rtt: make(map[int64]time.Duration)}, nil
+	case "version":
+		return &versionSelector{probe: probeVersion}, nil
+	}
+	return nil, fmt.Errorf("Unknown selection policy %s", name)
+}
+
+// randomSelector : uniformly random server
+type randomSelector struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (p *randomSelector) Choose(candidates []int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return candidates[p.r.Intn(len(candidates))]
+}
+
+func (p *randomSelector) Observe(server int64, rtt time.Duration, err error) {}
+
+// roundRobinSelector : the servers in turn
+type roundRobinSelector struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *roundRobinSelector) Choose(candidates []int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := candidates[p.next%len(candidates)]
+	p.next++
+	return s
+}
+
+func (p *roundRobinSelector) Observe(server int64, rtt time.Duration, err error) {}
+
+// stickySelector : the same server for every request until a call on it fails, then a
+// random other one. Keeps reads and writes of a client on one replica
+type stickySelector struct {
+	mu      sync.Mutex
+	r       *rand.Rand
+	current int64
+	chosen  bool
+}
+
+func (p *stickySelector) Choose(candidates []int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.chosen {
+		for _, s := range candidates {
+			if s == p.current {
+				return s
+			}
+		}
+	}
+	p.current = candidates[p.r.Intn(len(candidates))]
+	p.chosen = true
+	return p.current
+}
+
+func (p *stickySelector) Observe(server int64, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && p.chosen && server == p.current {
+		p.chosen = false
+	}
+}
+
+// Weight of the last call in the moving average of the latency of a server
+const latencyWeight = 0.3
+
+// latencySelector : the server with the lowest moving average of its call latency. Servers
+// without a measurement are tried first, a failed call counts as a very slow one
+type latencySelector struct {
+	mu  sync.Mutex
+	rtt map[int64]time.Duration
+}
+
+func (p *latencySelector) Choose(candidates []int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := candidates[0]
+	for _, s := range candidates {
+		rtt, ok := p.rtt[s]
+		if !ok {
+			return s
+		}
+		if rtt < p.rtt[best] {
+			best = s
+		}
+	}
+	return best
+}
+
+func (p *latencySelector) Observe(server int64, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		rtt = time.Minute
+	}
+	if old, ok := p.rtt[server]; ok {
+		rtt = time.Duration(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(old))
+	}
+	p.rtt[server] = rtt
+}
+
+// versionSelector : the server with the highest version number, the one that took part in
+// the latest stabilize. It asks every candidate for its version on each choice
+type versionSelector struct {
+	probe func(server int64) (int64, error)
+}
+
+func (p *versionSelector) Choose(candidates []int64) int64 {
+	best, bestVersion := candidates[0], int64(-1)
+	for _, s := range candidates {
+		version, err := p.probe(s)
+		if err != nil {
+			continue
+		}
+		if version > bestVersion {
+			best, bestVersion = s, version
+		}
+	}
+	return best
+}
+
+func (p *versionSelector) Observe(server int64, rtt time.Duration, err error) {}
+
+// probeVersion returns the version number of a connected server
+func probeVersion(server int64) (int64, error) {
+	client, ok := RPCclients[server]
+	if !ok {
+		return 0, errNoServer
+	}
+	var version int64
+	err := client.Call("ServerService.GetVersionNumber", &id, &version)
+	return version, err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Consistency levels of a read (R) or a write (W). A level is ONE, QUORUM, ALL or a number
+// of servers. Without a level a request goes to a single server and is not fanned out
+const (
+	levelOne    = "ONE"
+	levelQuorum = "QUORUM"
+	levelAll    = "ALL"
+)
+
+// quorum returns how many of n replicas must answer a request sent with level
+func quorum(level string, n int) (int, error) {
+	var need int
+	switch strings.ToUpper(level) {
+	case levelOne:
+		need = 1
+	case levelQuorum:
+		need = n/2 + 1
+	case levelAll:
+		need = n
+	default:
+		k, err := strconv.Atoi(level)
+		if err != nil || k <= 0 {
+			return 0, fmt.Errorf("Invalid consistency level %s", level)
+		}
+		need = k
+	}
+	if need > n {
+		return 0, fmt.Errorf("Consistency level %s needs %d servers but the client is connected to %d replicas", level, need, n)
+	}
+	return need, nil
+}
+
+// replicaSet returns the connected servers that store key: its preference list when keys
+// are partitioned, otherwise every connected server
+func replicaSet(key string) map[int64]*rpc.Client {
+	out := make(map[int64]*rpc.Client)
+	if replicas > 0 {
+		for _, s := range keyRing.Preference(key, replicas) {
+			if server, ok := RPCclients[s]; ok {
+				out[s] = server
+			}
+		}
+		return out
+	}
+	for s, server := range RPCclients {
+		out[s] = server
+	}
+	return out
+}
+
+// fanOut calls method on every server in parallel and returns the replies by server as soon
+// as need of them replied, along with the errors of the calls that failed so far. Replies
+// that arrive later are dropped. It fails if too many calls fail for the quorum to be reached
+func fanOut(servers map[int64]*rpc.Client, method string, arg interface{}, need int) (map[int64]cache.Payload, map[int64]error, error) {
+	type result struct {
+		server int64
+		reply  cache.Payload
+		err    error
+	}
+
+	// Buffered so that the calls still running after we return never block
+	results := make(chan result, len(servers))
+	for s, server := range servers {
+		go func(s int64, server *rpc.Client) {
+			var r result
+			r.server = s
+			start := time.Now()
+			r.err = server.Call(method, arg, &r.reply)
+			selector.Observe(s, time.Since(start), r.err)
+			results <- r
+		}(s, server)
+	}
+
+	replies := make(map[int64]cache.Payload)
+	failed := make(map[int64]error)
+	for len(replies) < need {
+		r := <-results
+		if r.err != nil {
+			debug(id, fmt.Sprintf("%s on server[%d] failed: %v", method, r.server, r.err))
+			failed[r.server] = r.err
+			if len(servers)-len(failed) < need {
+				return replies, failed, fmt.Errorf("%s got %d of %d replies needed, last error: %v", method, len(replies), need, r.err)
+			}
+			continue
+		}
+		debug(id, fmt.Sprintf("%s on server[%d] succeeded", method, r.server))
+		replies[r.server] = r.reply
+	}
+	return replies, failed, nil
+}
+
+// servedBy returns the servers that replied, in ascending order
+func servedBy(replies map[int64]cache.Payload) []int64 {
+	out := make([]int64, 0, len(replies))
+	for s := range replies {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// mergeResponses returns the newest of two Get responses. A missing key loses to anything.
+// Concurrent versions are ordered by the id of their clocks like the servers do, unless one
+// of the responses has siblings, then the live values of both become siblings
+func mergeResponses(a, b cache.Payload) cache.Payload {
+	if a.Val == "ERR_KEY" && !a.Deleted {
+		return b
+	}
+	if b.Val == "ERR_KEY" && !b.Deleted {
+		return a
+	}
+
+	switch a.ValTime.Time.Compare(&b.ValTime.Time) {
+	case vectorclock.GREATER:
+		return a
+	case vectorclock.LESS:
+		if a.ValTime.Time.Equal(&b.ValTime.Time) {
+			return a
+		}
+		return b
+	}
+
+	if len(a.Siblings) == 0 && len(b.Siblings) == 0 {
+		if a.ValTime.Compare(&b.ValTime) == vectorclock.GREATER {
+			return a
+		}
+		return b
+	}
+
+	out := a
+	out.Siblings = nil
+	seen := make(map[string]bool)
+	for _, p := range []cache.Payload{a, b} {
+		vals := []cache.Value{{Val: p.Val, Deleted: p.Deleted}}
+		vals = append(vals, p.Siblings...)
+		for _, v := range vals {
+			if v.Deleted || seen[v.Val] {
+				continue
+			}
+			seen[v.Val] = true
+			if out.Deleted {
+				out.Val, out.Deleted = v.Val, false
+			} else if v.Val != out.Val {
+				out.Siblings = append(out.Siblings, v)
+			}
+		}
+	}
+	out.ValTime = a.ValTime.Copy()
+	out.ValTime.Update(&b.ValTime)
+	out.Context = out.ValTime.Copy()
+	return out
+}
+
+// readRepair pushes newest to the servers whose response to a Get was older. Servers missing
+// the key are repaired only if newest came from a server. Repairs run in the background and
+// their replies are ignored. A version with siblings is not repaired: a Get response does
+// not carry the clock of each sibling, so the servers converge on it through stabilize
+func readRepair(key string, newest cache.Value, missing bool, replies map[int64]cache.Payload) {
+	if len(newest.Siblings) != 0 {
+		return
+	}
+
+	arg := cache.Payload{Key: key, Val: newest.Val, ValTime: newest.Clock.Copy(), Deleted: newest.Deleted, Expires: newest.Expires, Clock: vClock.Copy()}
+	for s, resp := range replies {
+		if resp.Val == "ERR_KEY" && !resp.Deleted {
+			if !missing {
+				continue
+			}
+		} else if resp.ValTime.Equal(&newest.Clock) || resp.ValTime.Compare(&newest.Clock) != vectorclock.LESS {
+			continue
+		}
+
+		server, ok := RPCclients[s]
+		if !ok {
+			continue
+		}
+		debug(id, fmt.Sprintf("Read repair of %s on server[%d]", key, s))
+		go func(s int64, server *rpc.Client) {
+			var reply cache.Payload
+			if err := server.Call("ServerService.Repair", &arg, &reply); err != nil {
+				debug(id, fmt.Sprintf("Read repair of %s on server[%d] failed: %v", key, s, err))
+			}
+		}(s, server)
+	}
+}
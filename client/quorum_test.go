@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/rpc"
+	"testing"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/ring"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+func TestQuorum(t *testing.T) {
+	tests := []struct {
+		level   string
+		n       int
+		want    int
+		wantErr bool
+	}{
+		{"ONE", 3, 1, false},
+		{"one", 3, 1, false},
+		{"QUORUM", 3, 2, false},
+		{"QUORUM", 4, 3, false},
+		{"QUORUM", 1, 1, false},
+		{"ALL", 3, 3, false},
+		{"2", 3, 2, false},
+		{"4", 3, 0, true},
+		{"0", 3, 0, true},
+		{"-1", 3, 0, true},
+		{"SOME", 3, 0, true},
+		{"ONE", 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := quorum(tt.level, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("quorum(%s, %d) error = %v, want error %t", tt.level, tt.n, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("quorum(%s, %d) = %d, want %d", tt.level, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestReplicaSet(t *testing.T) {
+	defer func(r int, k *ring.Ring, c map[int64]*rpc.Client) { replicas, keyRing, RPCclients = r, k, c }(replicas, keyRing, RPCclients)
+	keyRing = ring.New([]int64{1, 2, 3, 4})
+	RPCclients = map[int64]*rpc.Client{1: nil, 2: nil, 3: nil}
+
+	replicas = 0
+	if got := replicaSet("a"); len(got) != 3 {
+		t.Errorf("replicaSet without partitioning = %v, want every connected server", got)
+	}
+
+	replicas = 2
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		got := replicaSet(key)
+		for s := range got {
+			if !keyRing.Owns(s, key, replicas) {
+				t.Errorf("replicaSet(%s) has server %d, not a replica", key, s)
+			}
+		}
+		want := 0
+		for _, s := range keyRing.Preference(key, replicas) {
+			if _, ok := RPCclients[s]; ok {
+				want++
+			}
+		}
+		if len(got) != want {
+			t.Errorf("replicaSet(%s) = %v, want the %d connected replicas", key, got, want)
+		}
+	}
+}
+
+func clock(owner int64, time map[int64]int64) vectorclock.VectorClock {
+	return vectorclock.VectorClock{Time: vectorclock.TimeStamp{Time: time}, Id: owner}
+}
+
+func TestMergeResponses(t *testing.T) {
+	missing := cache.Payload{Val: "ERR_KEY"}
+	old := cache.Payload{Val: "old", ValTime: clock(1, map[int64]int64{1: 1})}
+	newer := cache.Payload{Val: "new", ValTime: clock(1, map[int64]int64{1: 2})}
+	tomb := cache.Payload{Val: "ERR_KEY", Deleted: true, ValTime: clock(1, map[int64]int64{1: 3})}
+	low := cache.Payload{Val: "low", ValTime: clock(1, map[int64]int64{1: 2})}
+	high := cache.Payload{Val: "high", ValTime: clock(2, map[int64]int64{2: 2})}
+	sib := cache.Payload{Val: "x", ValTime: clock(3, map[int64]int64{3: 1}), Siblings: []cache.Value{{Val: "y"}}}
+
+	tests := []struct {
+		name     string
+		a, b     cache.Payload
+		want     string
+		siblings []string
+	}{
+		{"missing loses", missing, old, "old", nil},
+		{"missing loses on the right", old, missing, "old", nil},
+		{"newer wins", old, newer, "new", nil},
+		{"newer wins on the left", newer, old, "new", nil},
+		{"tombstone wins over older value", newer, tomb, "ERR_KEY", nil},
+		{"tombstone wins over missing", missing, tomb, "ERR_KEY", nil},
+		{"equal keeps the first", old, old, "old", nil},
+		{"concurrent ordered by id", low, high, "high", nil},
+		{"concurrent ordered by id on the left", high, low, "high", nil},
+		{"siblings merged", sib, low, "x", []string{"y", "low"}},
+		{"same response once", sib, sib, "x", []string{"y"}},
+	}
+	for _, tt := range tests {
+		got := mergeResponses(tt.a, tt.b)
+		if got.Val != tt.want {
+			t.Errorf("%s: mergeResponses = %s, want %s", tt.name, got.Val, tt.want)
+			continue
+		}
+		if len(got.Siblings) != len(tt.siblings) {
+			t.Errorf("%s: siblings = %v, want %v", tt.name, got.Siblings, tt.siblings)
+			continue
+		}
+		for i, v := range got.Siblings {
+			if v.Val != tt.siblings[i] {
+				t.Errorf("%s: siblings = %v, want %v", tt.name, got.Siblings, tt.siblings)
+				break
+			}
+		}
+	}
+}
+
+func TestMergeResponsesContext(t *testing.T) {
+	a := cache.Payload{Val: "x", ValTime: clock(1, map[int64]int64{1: 2}), Siblings: []cache.Value{{Val: "y"}}}
+	b := cache.Payload{Val: "z", ValTime: clock(2, map[int64]int64{2: 3})}
+	got := mergeResponses(a, b)
+	want := vectorclock.TimeStamp{Time: map[int64]int64{1: 2, 2: 3}}
+	if !got.Context.Time.Equal(&want) || !got.ValTime.Time.Equal(&want) {
+		t.Errorf("context = %s, want the join of both clocks", got.Context.ToString())
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	got := servedBy(map[int64]cache.Payload{3: {}, 1: {}, 2: {}})
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("servedBy = %v, want [1 2 3]", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/link"
+)
+
+// deadConnection returns true if err means the connection to the server is gone, as
+// opposed to an error returned by the server
+func deadConnection(err error) bool {
+	return err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// dialServer connects to a server, which refuses if the link with this client is broken
+func dialServer(serverID int64) (*rpc.Client, error) {
+	serverPort := strconv.FormatInt(baseServerPort+serverID, 10)
+	return link.Dial("localhost:"+serverPort, link.Peer{Role: link.Client, ID: id})
+}
+
+// reconnect redials a server whose connection is dead and delivers the hints kept for it. If
+// the server cannot be reached it is dropped from the connected servers until
+// createConnection is called again
+func reconnect(serverID int64) {
+	if client, ok := RPCclients[serverID]; ok {
+		client.Close()
+	}
+
+	client, err := dialServer(serverID)
+	if err != nil {
+		debug(id, fmt.Sprintf("Connection to server[%d] is dead, dropping it: %v", serverID, err))
+		delete(RPCclients, serverID)
+		return
+	}
+	debug(id, fmt.Sprintf("Connection to server[%d] was dead and is redialed", serverID))
+	RPCclients[serverID] = client
+	deliverHints(serverID, client)
+	subscribeWatches(serverID, client)
+}
+
+// Error of a server asked for a key it is not a replica of, that cannot reach a replica
+const errNotReplica = "ERR_NOT_REPLICA"
+
+// checkFailed redials or drops the servers whose calls failed because of a dead connection.
+// A server that is not a replica of the key means the client's ring is out of date
+func checkFailed(failed map[int64]error) {
+	for s, err := range failed {
+		if deadConnection(err) {
+			reconnect(s)
+		} else if strings.HasPrefix(err.Error(), errNotReplica) {
+			learnMembers(RPCclients[s])
+		}
+	}
+}
+
+// nextServer returns the connected server a retry for key goes to: the replicas of the key
+// first, then the other servers, skipping the ones already tried. Once every server was
+// tried they are tried again, a redialed connection may work now. The servers in skip are
+// never returned
+func nextServer(key string, tried map[int64]bool, skip map[int64]bool) (int64, bool) {
+	var order []int64
+	if replicas > 0 {
+		order = keyRing.Preference(key, replicas)
+	}
+	var rest []int64
+	for s := range RPCclients {
+		rest = append(rest, s)
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i] < rest[j] })
+	order = append(order, rest...)
+
+	for _, s := range order {
+		if _, ok := RPCclients[s]; ok && !tried[s] && !skip[s] {
+			return s, true
+		}
+	}
+	for _, s := range order {
+		if _, ok := RPCclients[s]; ok && !skip[s] {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// withRetry calls try on up to retries servers for key, waiting backoff before the first
+// call and twice as long before each next one. tried holds the servers that already
+// failed, skip the ones it must not call. It returns the server that succeeded. Caller
+// holds lockClient, also while waiting: the request is half done, other requests must not
+// change its servers, clock or cache entries in the meantime
+func withRetry(key string, tried map[int64]bool, skip map[int64]bool, try func(s int64, server *rpc.Client) error) (int64, error) {
+	err := errNoServer
+	delay := backoff
+	for attempt := 0; attempt < retries; attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+
+		s, ok := nextServer(key, tried, skip)
+		if !ok {
+			return 0, errNoServer
+		}
+		tried[s] = true
+
+		debug(id, fmt.Sprintf("Retrying %s on server[%d], attempt %d", key, s, attempt+1))
+		start := time.Now()
+		err = try(s, RPCclients[s])
+		selector.Observe(s, time.Since(start), err)
+		if err == nil {
+			return s, nil
+		}
+		debug(id, fmt.Sprintf("Retry on server[%d] failed: %v", s, err))
+		checkFailed(map[int64]error{s: err})
+	}
+	return 0, err
+}
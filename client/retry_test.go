@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/ring"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+func TestNextServer(t *testing.T) {
+	defer func(r int, k *ring.Ring, c map[int64]*rpc.Client) { replicas, keyRing, RPCclients = r, k, c }(replicas, keyRing, RPCclients)
+	replicas = 0
+	keyRing = ring.New([]int64{1, 2, 3})
+	RPCclients = map[int64]*rpc.Client{1: nil, 2: nil, 3: nil}
+
+	tests := []struct {
+		name  string
+		tried map[int64]bool
+		skip  map[int64]bool
+		want  int64
+		ok    bool
+	}{
+		{"first server", nil, nil, 1, true},
+		{"tried ones come last", map[int64]bool{1: true}, nil, 2, true},
+		{"every one tried", map[int64]bool{1: true, 2: true, 3: true}, nil, 1, true},
+		{"skipped never", nil, map[int64]bool{1: true}, 2, true},
+		{"skipped never once all were tried", map[int64]bool{1: true, 2: true, 3: true}, map[int64]bool{1: true}, 2, true},
+		{"only skipped ones left", map[int64]bool{2: true}, map[int64]bool{1: true, 2: true, 3: true}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := nextServer("a", tt.tried, tt.skip)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: nextServer = %d, %t, want %d, %t", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// fakeServer : a ServerService keeping puts and hints in memory, or failing every call when down
+type fakeServer struct {
+	mu   sync.Mutex
+	down bool
+	data map[string]cache.Payload
+}
+
+func (f *fakeServer) store(p *cache.Payload, reply *cache.Payload) error {
+	if f.down {
+		return errors.New("server is down")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply.Clock = p.Clock
+	// Like a server, keep the newest version: a late read repair does not go back
+	if cur, ok := f.data[p.Key]; ok && p.ValTime.Time.Compare(&cur.ValTime.Time) == vectorclock.LESS {
+		return nil
+	}
+	f.data[p.Key] = *p
+	return nil
+}
+
+func (f *fakeServer) Put(arg *cache.Payload, reply *cache.Payload) error {
+	return f.store(arg, reply)
+}
+
+func (f *fakeServer) PutHint(arg *HintArgs, reply *cache.Payload) error {
+	return f.store(&arg.Payload, reply)
+}
+
+func (f *fakeServer) Repair(arg *cache.Payload, reply *cache.Payload) error {
+	return f.store(arg, reply)
+}
+
+func (f *fakeServer) Get(arg *cache.Payload, reply *cache.Payload) error {
+	if f.down {
+		return errors.New("server is down")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*reply = cache.Payload{Key: arg.Key, Val: "ERR_KEY", Clock: arg.Clock}
+	if p, ok := f.data[arg.Key]; ok {
+		reply.Val, reply.ValTime = p.Val, p.ValTime
+	}
+	return nil
+}
+
+func (f *fakeServer) get(key string) (cache.Payload, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.data[key]
+	return p, ok
+}
+
+// serve returns a client connected to f
+func serve(f *fakeServer) *rpc.Client {
+	server := rpc.NewServer()
+	server.RegisterName("ServerService", f)
+	a, b := net.Pipe()
+	go server.ServeConn(a)
+	return rpc.NewClient(b)
+}
+
+// Run with -race: puts and gets wait on the backoff of each other while a server is down. A
+// request holds the client until it is done, so the cache ends with the newest write of a key
+func TestRetryConcurrent(t *testing.T) {
+	defer func(c map[int64]*rpc.Client, k *ring.Ring, l *cache.LRU, s Selector, n int, b time.Duration) {
+		RPCclients, keyRing, cCache, selector, retries, backoff = c, k, l, s, n, b
+	}(RPCclients, keyRing, cCache, selector, retries, backoff)
+	// Read repairs run on after the request, they keep this logger
+	logger = log.New(io.Discard, "", 0)
+	cCache = cache.NewLRU(0)
+	selector, _ = newSelector("roundrobin")
+	retries, backoff = 2, time.Millisecond
+
+	up := []*fakeServer{{data: make(map[string]cache.Payload)}, {data: make(map[string]cache.Payload)}}
+	down := &fakeServer{down: true}
+	RPCclients = map[int64]*rpc.Client{1: serve(up[0]), 2: serve(up[1]), 3: serve(down)}
+	keyRing = ring.New([]int64{1, 2, 3})
+
+	cs := new(ClientService)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				var reply RequestReply
+				key := "k" + strconv.Itoa(i%5)
+				if err := cs.Put(&PutData{Key: key, Value: strconv.Itoa(w)}, &reply); err != nil {
+					t.Errorf("Put(%s) failed: %v", key, err)
+					return
+				}
+				for _, s := range reply.Servers {
+					if s == 3 {
+						t.Errorf("Put(%s) served by the server that is down", key)
+					}
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				var reply RequestReply
+				key := "k" + strconv.Itoa(i%5)
+				if err := cs.Get(&GetData{Key: key}, &reply); err != nil {
+					t.Errorf("Get(%s) failed: %v", key, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		key := "k" + strconv.Itoa(i)
+		newest, ok := up[0].get(key)
+		if p, ok1 := up[1].get(key); ok1 && (!ok || newest.ValTime.Time.Compare(&p.ValTime.Time) == vectorclock.LESS) {
+			newest, ok = p, true
+		}
+		if !ok {
+			t.Errorf("no server that is up took %s", key)
+			continue
+		}
+		cached, _ := cCache.Peek(&key)
+		if !cached.Clock.Time.Equal(&newest.ValTime.Time) {
+			t.Errorf("cache holds %s:%s at %s, the newest write is %s at %s", key, cached.Val, cached.Clock.ToString(), newest.Val, newest.ValTime.ToString())
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"sort"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// ScanData : RPC type for a range scan through the client. A Prefix scans the keys that
+// start with it instead of Start and End. Token is the one of the previous page
+type ScanData struct {
+	Start, End string
+	Prefix     string
+	Limit      int
+	Token      string
+}
+
+// ScanEntry : a key listed by a scan, with its value as seen by Get and its clock
+type ScanEntry struct {
+	Key, Val, Clock string
+}
+
+// ScanResult : RPC type for a page of a range scan. Token is passed back to get the next
+// page, it is empty after the last page
+type ScanResult struct {
+	Entries []ScanEntry
+	Token   string
+	Servers []int64
+}
+
+// ScanArgs : RPC type for ServerService.Scan
+type ScanArgs struct {
+	Start, End string
+	Limit      int
+	Clock      vectorclock.VectorClock
+	Deps       vectorclock.VectorClock
+}
+
+// ScanReply : RPC type for the reply of ServerService.Scan
+type ScanReply struct {
+	Entries []cache.Payload
+	Token   string
+	Clock   vectorclock.VectorClock
+	Version int64
+	Stable  vectorclock.VectorClock
+}
+
+// Scan: RPC to list the keys in a range in ascending order, with their values. When keys
+// are partitioned every connected server is asked and the pages are merged, so no key is
+// missed while fewer than replicas servers fail. Values the client caches, like its writes
+// that no server took yet, are merged in like in Get
+func (cs *ClientService) Scan(arg *ScanData, reply *ScanResult) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	start, end := arg.Start, arg.End
+	if arg.Prefix != "" {
+		start, end = arg.Prefix, prefixEnd(arg.Prefix)
+	}
+	if arg.Token != "" {
+		start = arg.Token
+	}
+	debug(id, fmt.Sprintf("Scanning [%s, %s) ...", start, end))
+
+	if len(RPCclients) == 0 {
+		return errNoServer
+	}
+
+	sArg := ScanArgs{Start: start, End: end, Limit: arg.Limit, Clock: vClock.Copy(), Deps: readDeps()}
+	scan := func(s int64, server *rpc.Client) (ScanReply, error) {
+		var r ScanReply
+		began := time.Now()
+		err := server.Call("ServerService.Scan", &sArg, &r)
+		selector.Observe(s, time.Since(began), err)
+		if err != nil {
+			debug(id, fmt.Sprintf("ServerService.Scan on server[%d] failed: %v", s, err))
+		}
+		return r, err
+	}
+
+	replies := make(map[int64]ScanReply)
+	var err error
+	if replicas > 0 {
+		failed := make(map[int64]error)
+		for s, server := range RPCclients {
+			var r ScanReply
+			if r, err = scan(s, server); err != nil {
+				failed[s] = err
+				continue
+			}
+			replies[s] = r
+		}
+		checkFailed(failed)
+	} else {
+		// A single server read is retried on the other servers
+		s, server := chooseServer(start)
+		var r ScanReply
+		if r, err = scan(s, server); err != nil {
+			checkFailed(map[int64]error{s: err})
+			s, err = withRetry(start, map[int64]bool{s: true}, nil, func(s int64, server *rpc.Client) error {
+				r, err = scan(s, server)
+				return err
+			})
+		}
+		if err == nil {
+			replies[s] = r
+		}
+	}
+	if len(replies) == 0 {
+		return fmt.Errorf("Scan failed on every server, last error: %v", err)
+	}
+
+	// A server listed every key before its token, the merged page ends at the first token
+	entries := make(map[string]cache.Payload)
+	token := ""
+	for s, r := range replies {
+		learnVersion(s, r.Version, &r.Stable)
+		vClock.Update(&r.Clock)
+		if r.Token != "" && (token == "" || r.Token < token) {
+			token = r.Token
+		}
+		for _, e := range r.Entries {
+			if cur, ok := entries[e.Key]; ok {
+				e = mergeResponses(cur, e)
+			}
+			entries[e.Key] = e
+		}
+	}
+	bound := end
+	if token != "" {
+		bound = token
+	}
+
+	values := make(map[string]cache.Value)
+	for k, e := range entries {
+		if k < bound || bound == "" {
+			values[k] = cache.Value{Val: e.Val, Clock: e.ValTime, Deleted: e.Deleted, Expires: e.Expires, Siblings: e.Siblings}
+		}
+	}
+	for k, val := range cCache.Range(start, bound) {
+		if cur, ok := values[k]; !ok || cur.Clock.Compare(&val.Clock) == vectorclock.LESS {
+			values[k] = val
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k, val := range values {
+		if !val.Deleted {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if arg.Limit > 0 && len(keys) > arg.Limit {
+		token = keys[arg.Limit]
+		keys = keys[:arg.Limit]
+	}
+
+	for _, k := range keys {
+		val := values[k]
+		readClock.Update(&val.Clock)
+		reply.Entries = append(reply.Entries, ScanEntry{Key: k, Val: cachedVal(val), Clock: val.Clock.ToString()})
+	}
+	reply.Token = token
+	reply.Servers = make([]int64, 0, len(replies))
+	for s := range replies {
+		reply.Servers = append(reply.Servers, s)
+	}
+	sort.Slice(reply.Servers, func(i, j int) bool { return reply.Servers[i] < reply.Servers[j] })
+	return nil
+}
+
+// prefixEnd returns the first key after every key that starts with prefix, empty if there is
+// no such key
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Session guarantees the servers can enforce for a client. The cache of the client gives
+// read-your-writes and monotonic reads on its own; asking the servers for them too makes a
+// server wait for, or refuse, a request it could only serve with older data
+const (
+	readYourWrites    = "ryw" // a Get goes to a server that has seen the writes of the session
+	monotonicReads    = "mr"  // a Get goes to a server that has seen what the session read
+	monotonicWrites   = "mw"  // a Put goes to a server that has seen the writes of the session
+	writesFollowReads = "wfr" // a Put goes to a server that has seen what the session read
+)
+
+var session = make(map[string]bool) // guarantees enabled for this client
+
+// Join of the clocks of the values the session read, and of the writes it made
+var readClock vectorclock.VectorClock
+var writeClock vectorclock.VectorClock
+
+// parseSession enables the guarantees of a comma separated list
+func parseSession(list string) error {
+	for _, g := range strings.Split(list, ",") {
+		switch g {
+		case "":
+		case readYourWrites, monotonicReads, monotonicWrites, writesFollowReads:
+			session[g] = true
+		default:
+			return fmt.Errorf("Unknown session guarantee %s", g)
+		}
+	}
+	return nil
+}
+
+// sessionDeps returns the join of the clocks a server must have seen to serve a request
+// under the guarantees onWrites (based on the writes) and onReads (based on the reads)
+func sessionDeps(onWrites, onReads string) vectorclock.VectorClock {
+	var deps vectorclock.VectorClock
+	deps.Id = id
+	if session[onWrites] {
+		deps.Update(&writeClock)
+	}
+	if session[onReads] {
+		deps.Update(&readClock)
+	}
+	return deps
+}
+
+// readDeps returns the session dependencies of a Get
+func readDeps() vectorclock.VectorClock {
+	return sessionDeps(readYourWrites, monotonicReads)
+}
+
+// writeDeps returns the session dependencies of a Put or Delete
+func writeDeps() vectorclock.VectorClock {
+	return sessionDeps(monotonicWrites, writesFollowReads)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// How long a poll of a server subscription waits for a notification, and the wait after a
+// poll that failed
+const serverPollWait = 5 * time.Second
+const pollRetryDelay = 500 * time.Millisecond
+
+// WatchData : RPC type for a watch through the client, of a key or of every key that starts
+// with Prefix when it is set
+type WatchData struct {
+	Key    string
+	Prefix string
+}
+
+// WatchPoll : RPC type for a poll of the notifications of a watch
+type WatchPoll struct {
+	ID   int64
+	Wait time.Duration
+}
+
+// WatchNote : a change of a key seen by a watch, with the value as seen by Get and its clock.
+// Cause and Server tell what changed the key on which server
+type WatchNote struct {
+	Key, Val, Clock string
+	Deleted         bool
+	Cause           string
+	Server          int64
+}
+
+// WatchNotes : RPC type for the notifications of a watch since the last poll. Lost is the
+// number of notifications the servers dropped because they were not polled in time
+type WatchNotes struct {
+	Notes []WatchNote
+	Lost  int
+}
+
+// WatchArgs : RPC type for ServerService.Watch
+type WatchArgs struct {
+	Key    string
+	Prefix string
+}
+
+// WatchEvent : notification of ServerService.PollWatch
+type WatchEvent struct {
+	Key    string
+	Value  cache.Value
+	Cause  string
+	Server int64
+}
+
+// PollArgs : RPC type for ServerService.PollWatch
+type PollArgs struct {
+	ID   int64
+	Wait time.Duration
+}
+
+// PollReply : RPC type for the reply of ServerService.PollWatch
+type PollReply struct {
+	Events []WatchEvent
+	Lost   int
+}
+
+// watch : a watch subscribed on every connected server. The notifications of the servers
+// are polled in the background and merged: each version of a key is kept once, and a
+// version older than one already seen is dropped
+type watch struct {
+	arg WatchArgs
+
+	mu     sync.Mutex
+	notes  []WatchNote
+	lost   int
+	seen   map[string]seenVersion // newest version seen of each key
+	subs   map[int64]int64        // subscription id on each server
+	wake   chan struct{}          // signaled when a notification arrives
+	closed bool
+}
+
+// seenVersion : join of the clocks of the versions of a key a watch has seen, and whether
+// the key was deleted at that clock. A value expires into a tombstone of the same clock
+type seenVersion struct {
+	clock   vectorclock.VectorClock
+	deleted bool
+}
+
+// Watches of the client by id. Only changed while holding lockClient
+var watches = make(map[int64]*watch)
+var nextWatchID int64
+
+// Watch: RPC to start watching a key or a prefix. Replies the id of the watch, whose
+// notifications are read with PollWatch
+func (cs *ClientService) Watch(arg *WatchData, reply *int64) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	if len(RPCclients) == 0 {
+		return errNoServer
+	}
+
+	w := &watch{
+		arg:  WatchArgs{Key: arg.Key, Prefix: arg.Prefix},
+		seen: make(map[string]seenVersion),
+		subs: make(map[int64]int64),
+		wake: make(chan struct{}, 1),
+	}
+	for s, server := range RPCclients {
+		w.subscribe(s, server)
+	}
+	if len(w.subs) == 0 {
+		return fmt.Errorf("Watch failed on every server")
+	}
+
+	nextWatchID++
+	watches[nextWatchID] = w
+	*reply = nextWatchID
+	debug(id, fmt.Sprintf("Watch %d of key %q prefix %q on servers %v", nextWatchID, arg.Key, arg.Prefix, w.servers()))
+	return nil
+}
+
+// PollWatch: RPC to read the notifications of a watch. It waits up to arg.Wait for one if
+// there is none yet
+func (cs *ClientService) PollWatch(arg *WatchPoll, reply *WatchNotes) error {
+	// lockClient is only held to find the watch, waiting under it would hold every request
+	lockClient.Lock()
+	w, ok := watches[arg.ID]
+	lockClient.Unlock()
+	if !ok {
+		return fmt.Errorf("Client[%d] has no watch %d", id, arg.ID)
+	}
+
+	w.mu.Lock()
+	if len(w.notes) == 0 && arg.Wait > 0 {
+		w.mu.Unlock()
+		select {
+		case <-w.wake:
+		case <-time.After(arg.Wait):
+		}
+		w.mu.Lock()
+	}
+	reply.Notes, reply.Lost = w.notes, w.lost
+	w.notes, w.lost = nil, 0
+	select {
+	case <-w.wake:
+	default:
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+// Unwatch: RPC to stop a watch and remove its subscriptions on the servers
+func (cs *ClientService) Unwatch(watchID *int64, reply *int64) error {
+	lockClient.Lock()
+	defer lockClient.Unlock()
+
+	w, ok := watches[*watchID]
+	if !ok {
+		return fmt.Errorf("Client[%d] has no watch %d", id, *watchID)
+	}
+	delete(watches, *watchID)
+
+	w.mu.Lock()
+	w.closed = true
+	subs := make(map[int64]int64, len(w.subs))
+	for s, subID := range w.subs {
+		subs[s] = subID
+	}
+	w.mu.Unlock()
+	for s, subID := range subs {
+		if server, ok := RPCclients[s]; ok {
+			var dummy int64
+			server.Call("ServerService.Unwatch", &subID, &dummy)
+		}
+	}
+	debug(id, fmt.Sprintf("Watch %d stopped", *watchID))
+	return nil
+}
+
+// subscribeWatches subscribes the watches of the client on a newly connected server
+func subscribeWatches(serverID int64, server *rpc.Client) {
+	for _, w := range watches {
+		w.subscribe(serverID, server)
+	}
+}
+
+// subscribe subscribes the watch on a server and starts polling it. Does nothing if the
+// watch already polls that server
+func (w *watch) subscribe(serverID int64, server *rpc.Client) {
+	w.mu.Lock()
+	_, ok := w.subs[serverID]
+	w.mu.Unlock()
+	if ok {
+		return
+	}
+
+	var subID int64
+	if err := server.Call("ServerService.Watch", &w.arg, &subID); err != nil {
+		debug(id, fmt.Sprintf("Subscribing on server[%d] failed: %v", serverID, err))
+		return
+	}
+	w.mu.Lock()
+	w.subs[serverID] = subID
+	w.mu.Unlock()
+	go w.poll(serverID, subID, server)
+}
+
+// poll reads the notifications of a server subscription until the watch is closed or the
+// connection to the server is gone
+func (w *watch) poll(serverID, subID int64, server *rpc.Client) {
+	arg := PollArgs{ID: subID, Wait: serverPollWait}
+	for {
+		var reply PollReply
+		err := server.Call("ServerService.PollWatch", &arg, &reply)
+
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		if err != nil {
+			debug(id, fmt.Sprintf("Polling server[%d] failed: %v", serverID, err))
+			if deadConnection(err) {
+				// A new connection to the server subscribes again
+				delete(w.subs, serverID)
+				w.mu.Unlock()
+				return
+			}
+			w.mu.Unlock()
+
+			// The server dropped the subscription, it was not polled in time
+			time.Sleep(pollRetryDelay)
+			if err := server.Call("ServerService.Watch", &w.arg, &arg.ID); err != nil {
+				continue
+			}
+			w.mu.Lock()
+			w.subs[serverID] = arg.ID
+			w.mu.Unlock()
+			continue
+		}
+		w.lost += reply.Lost
+		for _, e := range reply.Events {
+			w.add(e)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// add keeps a notification unless its version of the key was already seen or is older
+// than one that was. Caller holds w.mu
+func (w *watch) add(e WatchEvent) {
+	seen, ok := w.seen[e.Key]
+	if ok {
+		t := &e.Value.Clock.Time
+		if t.Equal(&seen.clock.Time) {
+			// The same version again, unless it expired since
+			if seen.deleted || !e.Value.Deleted {
+				return
+			}
+		} else if t.Compare(&seen.clock.Time) == vectorclock.LESS {
+			return
+		}
+	}
+	seen.clock.Update(&e.Value.Clock)
+	seen.deleted = e.Value.Deleted && seen.clock.Time.Equal(&e.Value.Clock.Time)
+	w.seen[e.Key] = seen
+
+	w.notes = append(w.notes, WatchNote{
+		Key:     e.Key,
+		Val:     cachedVal(e.Value),
+		Clock:   e.Value.Clock.ToString(),
+		Deleted: e.Value.Deleted,
+		Cause:   e.Cause,
+		Server:  e.Server,
+	})
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// servers returns the servers the watch is subscribed on, in ascending order
+func (w *watch) servers() []int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]int64, 0, len(w.subs))
+	for s := range w.subs {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
@@ -0,0 +1,204 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles of the processes that dial a server
+const (
+	Server = "server"
+	Client = "client"
+	Master = "master"
+)
+
+// A handshake that takes longer than handshakeTimeout fails the connection
+const handshakeTimeout = 2 * time.Second
+
+// Peer : the process at the other end of a connection, as told by its handshake
+type Peer struct {
+	Role string
+	ID   int64
+}
+
+// Info : the link of a server with a peer, as listed by master
+type Info struct {
+	Peer   int64
+	Role   string
+	Out    bool // the server has a connection it dialed to the peer
+	In     int  // connections the peer dialed to the server that are open
+	Broken bool // breakConnection was called and createConnection was not since
+}
+
+// Dial connects to the RPC server at addr as self. The first line of the connection tells
+// the server who dials, and the server answers OK or REJECT with a reason. A rejected or
+// failed handshake is returned as an error
+func Dial(addr string, self Peer) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if _, err = fmt.Fprintf(conn, "%s %d\n", self.Role, self.ID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	answer, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s failed: %v", addr, err)
+	}
+	if answer != "OK" {
+		conn.Close()
+		return nil, fmt.Errorf("%s refused the connection: %s", addr, strings.TrimPrefix(answer, "REJECT "))
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// readLine reads a line one byte at a time, so that nothing after it is consumed
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 64 {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("handshake line too long")
+}
+
+// Table : the links of a server with the processes that dial it. A connection is only
+// served while its peer is not cut off, and cutting a peer off closes its open connections.
+// Master is never cut off
+type Table struct {
+	mu     sync.Mutex
+	broken map[int64]bool
+	conns  map[net.Conn]Peer
+}
+
+// NewTable returns a table where every peer is linked
+func NewTable() *Table {
+	return &Table{broken: make(map[int64]bool), conns: make(map[net.Conn]Peer)}
+}
+
+// Serve accepts connections on l and serves the RPCs of the default rpc server on the
+// connections of the peers that are not cut off
+func (t *Table) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go t.serveConn(conn)
+	}
+}
+
+func (t *Table) serveConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	line, err := readLine(conn)
+	var peer Peer
+	if err == nil {
+		_, err = fmt.Sscanf(line, "%s %d", &peer.Role, &peer.ID)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "REJECT bad handshake\n")
+		conn.Close()
+		return
+	}
+
+	// Checked and registered at once, so that Cut closes every connection it let in
+	t.mu.Lock()
+	if peer.Role != Master && t.broken[peer.ID] {
+		t.mu.Unlock()
+		fmt.Fprintf(conn, "REJECT the link with %s %d is broken\n", peer.Role, peer.ID)
+		conn.Close()
+		return
+	}
+	t.conns[conn] = peer
+	t.mu.Unlock()
+
+	fmt.Fprintf(conn, "OK\n")
+	conn.SetDeadline(time.Time{})
+	rpc.ServeConn(conn)
+
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+// Cut cuts a peer off: its open connections are closed and it cannot connect again until
+// Restore. Returns the number of connections closed
+func (t *Table) Cut(peer int64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.broken[peer] = true
+	return t.closeLocked(peer)
+}
+
+// Drop closes the open connections of a peer, which can still connect again
+func (t *Table) Drop(peer int64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeLocked(peer)
+}
+
+func (t *Table) closeLocked(peer int64) int {
+	n := 0
+	for conn, p := range t.conns {
+		if p.Role != Master && p.ID == peer {
+			conn.Close()
+			delete(t.conns, conn)
+			n++
+		}
+	}
+	return n
+}
+
+// Restore lets a peer that was cut off connect again
+func (t *Table) Restore(peer int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.broken, peer)
+}
+
+// Broken returns whether a peer is cut off
+func (t *Table) Broken(peer int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.broken[peer]
+}
+
+// Links returns the link with every peer that has an open connection to the server or was
+// cut off. Out is left to the caller, the table only knows inbound connections
+func (t *Table) Links() map[int64]*Info {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[int64]*Info)
+	for _, p := range t.conns {
+		if p.Role == Master {
+			continue
+		}
+		if _, ok := out[p.ID]; !ok {
+			out[p.ID] = &Info{Peer: p.ID, Role: p.Role}
+		}
+		out[p.ID].In++
+	}
+	for peer := range t.broken {
+		if _, ok := out[peer]; !ok {
+			out[peer] = &Info{Peer: peer}
+		}
+		out[peer].Broken = true
+	}
+	return out
+}
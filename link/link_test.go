@@ -0,0 +1,139 @@
+package link
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve starts a table on a free local port and returns it with its address
+func serve(t *testing.T) (*Table, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	table := NewTable()
+	go table.Serve(l)
+	return table, l.Addr().String()
+}
+
+func TestHandshake(t *testing.T) {
+	table, addr := serve(t)
+	table.Cut(2)
+
+	tests := []struct {
+		name   string
+		self   Peer
+		reject string // part of the error of a refused dial, empty if accepted
+	}{
+		{"server", Peer{Role: Server, ID: 1}, ""},
+		{"client", Peer{Role: Client, ID: 10}, ""},
+		{"broken link", Peer{Role: Server, ID: 2}, "the link with server 2 is broken"},
+		{"broken link of a client with the same id", Peer{Role: Client, ID: 2}, "the link with client 2 is broken"},
+		{"master is never cut off", Peer{Role: Master, ID: 2}, ""},
+	}
+	for _, tt := range tests {
+		client, err := Dial(addr, tt.self)
+		if tt.reject == "" {
+			if err != nil {
+				t.Errorf("%s: Dial failed: %v", tt.name, err)
+				continue
+			}
+			client.Close()
+			continue
+		}
+		if err == nil {
+			client.Close()
+			t.Errorf("%s: Dial succeeded, want it refused", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "refused the connection") || !strings.Contains(err.Error(), tt.reject) {
+			t.Errorf("%s: Dial error = %v, want a REJECT with %q", tt.name, err, tt.reject)
+		}
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	_, addr := serve(t)
+	tests := []string{"hello\n", "server x\n", "\n"}
+	for _, line := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(line))
+		answer, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if !strings.HasPrefix(answer, "REJECT") {
+			t.Errorf("handshake %q answered %q, want REJECT", line, answer)
+		}
+	}
+}
+
+func TestCutAndRestore(t *testing.T) {
+	table, addr := serve(t)
+	client, err := Dial(addr, Peer{Role: Server, ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	master, err := Dial(addr, Peer{Role: Master})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	if info := table.Links()[1]; info == nil || info.In != 1 || info.Role != Server || info.Broken {
+		t.Fatalf("link with 1 = %+v, want one open connection", info)
+	}
+	if n := table.Cut(1); n != 1 {
+		t.Errorf("Cut closed %d connection(s), want 1", n)
+	}
+	if err := client.Call("Nothing.Here", 0, new(int)); err == nil || strings.Contains(err.Error(), "can't find") {
+		t.Errorf("call on a cut connection = %v, want the connection closed", err)
+	}
+	if err := master.Call("Nothing.Here", 0, new(int)); err == nil || !strings.Contains(err.Error(), "can't find") {
+		t.Errorf("call of master after Cut = %v, want the server to answer", err)
+	}
+	if info := table.Links()[1]; info == nil || info.In != 0 || !info.Broken || !table.Broken(1) {
+		t.Errorf("link with 1 after Cut = %+v, want broken without connections", info)
+	}
+	if _, err := Dial(addr, Peer{Role: Server, ID: 1}); err == nil {
+		t.Errorf("Dial after Cut succeeded")
+	}
+
+	table.Restore(1)
+	again, err := Dial(addr, Peer{Role: Server, ID: 1})
+	if err != nil {
+		t.Fatalf("Dial after Restore failed: %v", err)
+	}
+	defer again.Close()
+	if table.Broken(1) {
+		t.Errorf("link with 1 still broken after Restore")
+	}
+}
+
+func TestDrop(t *testing.T) {
+	table, addr := serve(t)
+	client, err := Dial(addr, Peer{Role: Client, ID: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if n := table.Drop(10); n != 1 {
+		t.Errorf("Drop closed %d connection(s), want 1", n)
+	}
+	if table.Broken(10) {
+		t.Errorf("Drop cut the peer off")
+	}
+	again, err := Dial(addr, Peer{Role: Client, ID: 10})
+	if err != nil {
+		t.Fatalf("Dial after Drop failed: %v", err)
+	}
+	again.Close()
+}
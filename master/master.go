@@ -2,16 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net/rpc"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/huydoan2/eventual_consistency/link"
 )
 
 var baseServerPort int64 = 5000
@@ -21,16 +26,128 @@ var clients = make(map[int64]*rpc.Client)     // map[server id][client rpc handl
 var serverProcess = make(map[int64]*exec.Cmd) // map[server id][server procees]
 var clientProcess = make(map[int64]*exec.Cmd) // map[client id][client process]
 
+// A stabilize round that loses a subtree is retried this many times
+const maxStabilizeRetries = 2
+const stabilizeRetryDelay = 500 * time.Millisecond
+
 type PutData struct {
 	Key, Value string
+	W          string
+	TTL        time.Duration
+}
+
+type GetData struct {
+	Key string
+	R   string
+}
+
+// RequestReply : reply of the put, delete and get calls on a client. Servers are the
+// servers that served the request
+type RequestReply struct {
+	Val     string
+	Servers []int64
+}
+
+// ScanData : arguments of ClientService.Scan
+type ScanData struct {
+	Start, End string
+	Prefix     string
+	Limit      int
+	Token      string
+}
+
+// ScanEntry : a key listed by a scan
+type ScanEntry struct {
+	Key, Val, Clock string
+}
+
+// ScanResult : reply of ClientService.Scan, a page of a scan
+type ScanResult struct {
+	Entries []ScanEntry
+	Token   string
+	Servers []int64
+}
+
+// BatchData : arguments of ClientService.PutBatch
+type BatchData struct {
+	Keys, Values []string
+	W            string
+	TTL          time.Duration
+}
+
+// WatchData : arguments of ClientService.Watch
+type WatchData struct {
+	Key    string
+	Prefix string
+}
+
+// WatchPoll : arguments of ClientService.PollWatch
+type WatchPoll struct {
+	ID   int64
+	Wait time.Duration
+}
+
+// WatchNote : a change of a key seen by a watch
+type WatchNote struct {
+	Key, Val, Clock string
+	Deleted         bool
+	Cause           string
+	Server          int64
 }
 
-func ExecServer(id int64) {
+// WatchNotes : reply of ClientService.PollWatch
+type WatchNotes struct {
+	Notes []WatchNote
+	Lost  int
+}
+
+// CacheStats : reply of ClientService.CacheStats
+type CacheStats struct {
+	Entries, Pinned, Capacity int
+	Hits, Misses, Evictions   int64
+}
+
+// StabilizeReport : reply of ServerService.InitStabilize
+type StabilizeReport struct {
+	Round     int64
+	Root      int64
+	Servers   map[int64]bool      // servers in the MST that applied the round
+	Failed    map[int64]string    // servers whose subtree was lost, with the error
+	Tree      map[int64][]int64   // children of each server in the MST
+	Nodes     map[int64]NodeStats // entries and bytes each server sent and received
+	Conflicts []Conflict          // concurrent versions ordered in Gather
+	Bytes     int64               // bytes of every Gather reply and Scatter call of the round
+
+	// Time spent in each phase of the round
+	GatherTime   time.Duration
+	ScatterTime  time.Duration
+	EndRoundTime time.Duration
+}
+
+// NodeStats : what a server of the MST sent and received in a stabilize round
+type NodeStats struct {
+	Gathered  int   // entries it replied to Gather, from its cache and its subtree
+	Scattered int   // entries its parent scattered to it
+	BytesUp   int64 // size of its Gather reply
+	BytesDown int64 // size of the Scatter call its parent made to it
+}
+
+// Conflict : concurrent versions of a key that met on a server during Gather
+type Conflict struct {
+	Key    string
+	Server int64
+	Kept   string
+	Other  string
+	How    string
+}
+
+func ExecServer(id int64, peers []int64, options []string) {
 	server := exec.Command("./server", strconv.FormatInt(id, 10))
 
-	for serverID, _ := range serverProcess {
+	for _, serverID := range peers {
 		server.Args = append(server.Args, strconv.FormatInt(serverID, 10))
 	}
+	server.Args = append(server.Args, toFlags(options)...)
 
 	serverProcess[id] = server
 	serverErr := server.Start()
@@ -43,8 +160,9 @@ func ExecServer(id int64) {
 	fmt.Printf("Server %d finished with %v\n", id, exitCode)
 }
 
-func ExecClient(clientId, serverId int64) {
+func ExecClient(clientId, serverId int64, options []string) {
 	client := exec.Command("./client", strconv.FormatInt(clientId, 10), strconv.FormatInt(serverId, 10))
+	client.Args = append(client.Args, toFlags(options)...)
 	clientProcess[clientId] = client
 	clientErr := client.Start()
 	//fmt.Printf("%s\n", serverOut)
@@ -56,7 +174,8 @@ func ExecClient(clientId, serverId int64) {
 	fmt.Printf("Client %d finished with %v\n", clientId, exitCode)
 }
 
-func joinServer(id int64) {
+// joinServer : start server id. Each option is name or name=value, passed to the server as -name=value
+func joinServer(id int64, options ...string) {
 	const maxCount = 100
 	count := 0
 	fmt.Printf("Join Server[%d]\n", id)
@@ -70,14 +189,16 @@ func joinServer(id int64) {
 		return
 	}
 
-	go ExecServer(id)
+	// Only the servers alive now, a killed one is not on the ring anymore
+	go ExecServer(id, serverIDs(), options)
 	serverPort := strconv.FormatInt(baseServerPort+id, 10)
 
-	client, err := rpc.Dial("tcp", "localhost:"+serverPort)
+	self := link.Peer{Role: link.Master}
+	client, err := link.Dial("localhost:"+serverPort, self)
 	for err != nil && count < maxCount {
 		time.Sleep(time.Millisecond * 100)
 		count++
-		client, err = rpc.Dial("tcp", "localhost:"+serverPort)
+		client, err = link.Dial("localhost:"+serverPort, self)
 	}
 
 	if err != nil {
@@ -85,11 +206,34 @@ func joinServer(id int64) {
 	} else {
 		servers[id] = client
 		fmt.Printf("Connection with Server[%d] established!\n", id)
+		announceMembers()
 	}
 
 }
 
-func joinClient(clientId, serverID int64) {
+// serverIDs returns the ids of the servers alive, in ascending order
+func serverIDs() []int64 {
+	list := make([]int64, 0, len(servers))
+	for s := range servers {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// announceMembers tells every client the servers on the ring, after a server joined or left
+func announceMembers() {
+	list := serverIDs()
+	for clientID, client := range clients {
+		var reply int64
+		if err := client.Call("ClientService.Members", &list, &reply); err != nil {
+			fmt.Printf("Cannot update the ring of Client[%d]: %v\n", clientID, err)
+		}
+	}
+}
+
+// joinClient : start client clientId connected to serverID. Options are passed like in joinServer
+func joinClient(clientId, serverID int64, options ...string) {
 	const maxCount = 100
 	count := 0
 	fmt.Printf("Join Client[%d]-Server[%d]\n", clientId, serverID)
@@ -101,7 +245,7 @@ func joinClient(clientId, serverID int64) {
 		return
 	}
 
-	go ExecClient(clientId, serverID)
+	go ExecClient(clientId, serverID, options)
 	clientPort := strconv.FormatInt(baseClientPort+clientId, 10)
 
 	client, err := rpc.Dial("tcp", "localhost:"+clientPort)
@@ -138,6 +282,13 @@ func killServer(id int64) error {
 		delete(servers, id)
 		// Murder
 		serverProcess[id].Process.Kill()
+		// The other servers close their connections with it and elect their leaders again.
+		// They do not cut it off, it may join again
+		for _, other := range servers {
+			var reply int64
+			other.Call("ServerService.PeerLeft", &id, &reply)
+		}
+		announceMembers()
 	} else {
 		errorString := fmt.Sprintf("Server[%d] does not exist", id)
 		return errors.New(errorString)
@@ -157,13 +308,18 @@ func breakConnection(id1 int64, id2 int64) error {
 		if id2Client {
 			return errors.New("can't break connection between 2 clients")
 		} else if id2Server {
+			// The server cuts the client off too, so it cannot connect again on its own
+			var dummy int64
 			clients[id1].Call("ClientService.BreakConnection", &id2, &reply1)
+			servers[id2].Call("ServerService.BreakConnection", &id1, &dummy)
 		} else {
 			return errors.New("id2 out of range")
 		}
 	} else if id1Server {
 		if id2Client {
+			var dummy int64
 			clients[id2].Call("ClientService.BreakConnection", &id1, &reply2)
+			servers[id1].Call("ServerService.BreakConnection", &id2, &dummy)
 		} else if id2Server {
 			servers[id1].Call("ServerService.BreakConnection", &id2, &reply1)
 			servers[id2].Call("ServerService.BreakConnection", &id1, &reply2)
@@ -195,16 +351,28 @@ func createConnection(id1 int64, id2 int64) error {
 		if id2Client {
 			return errors.New("can't create connection between 2 clients")
 		} else if id2Server {
-			clients[id1].Call("ClientService.CreateConnection", &id2, &reply1)
+			var dummy int64
+			servers[id2].Call("ServerService.AdmitClient", &id1, &dummy)
+			if err := clients[id1].Call("ClientService.CreateConnection", &id2, &reply1); err != nil {
+				fmt.Printf("Connection from %d to %d failed: %v\n", id1, id2, err)
+			}
 		} else {
 			return errors.New("id2 out of range")
 		}
 	} else if id1Server {
 		if id2Client {
-			clients[id2].Call("ClientService.CreateConnection", &id1, &reply2)
+			var dummy int64
+			servers[id1].Call("ServerService.AdmitClient", &id2, &dummy)
+			if err := clients[id2].Call("ClientService.CreateConnection", &id1, &reply2); err != nil {
+				fmt.Printf("Connection from %d to %d failed: %v\n", id2, id1, err)
+			}
 		} else if id2Server {
+			// The first call fails while id2 still cuts id1 off. The second one lets id1 in
+			// and asks it to connect back
 			servers[id1].Call("ServerService.CreateConnection", &id2, &reply1)
-			servers[id2].Call("ServerService.CreateConnection", &id1, &reply2)
+			if err := servers[id2].Call("ServerService.CreateConnection", &id1, &reply2); err != nil {
+				fmt.Printf("Connection from %d to %d failed: %v\n", id2, id1, err)
+			}
 		} else {
 			return errors.New("id2 out of range")
 		}
@@ -220,6 +388,40 @@ func createConnection(id1 int64, id2 int64) error {
 	return nil
 }
 
+// printLinks : print the link table of a server, or of every server when id is negative
+func printLinks(id int64) {
+	ids := make([]int64, 0, len(servers))
+	for k := range servers {
+		if id < 0 || k == id {
+			ids = append(ids, k)
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Printf("Server[%d] does not exist\n", id)
+		return
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, k := range ids {
+		var table []link.Info
+		var arg int64
+		if err := servers[k].Call("ServerService.Links", &arg, &table); err != nil {
+			fmt.Printf("Server[%d]: %v\n", k, err)
+			continue
+		}
+		fmt.Printf("Links of Server[%d]:\n", k)
+		for _, l := range table {
+			state := "up"
+			if l.Broken {
+				state = "broken"
+			} else if !l.Out && l.Role == link.Server {
+				state = "half open"
+			}
+			fmt.Printf("\t%s %d: %s, out %t, in %d\n", l.Role, l.Peer, state, l.Out, l.In)
+		}
+	}
+}
+
 func printStore(id int64) {
 	fmt.Printf("Printing store of Server[%d]\n", id)
 	var server *rpc.Client
@@ -245,7 +447,133 @@ func printStore(id int64) {
 
 }
 
-func put(clientId int64, key, value string) {
+// printCacheStats : print the counters of the cache of a client
+func printCacheStats(clientId int64) {
+	fmt.Printf("Printing cache counters of Client[%d]\n", clientId)
+	client, ok := clients[clientId]
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	var stats CacheStats
+	var dummy int64
+	err := client.Call("ClientService.CacheStats", &dummy, &stats)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	fmt.Printf("entries:%d pinned:%d capacity:%d\n", stats.Entries, stats.Pinned, stats.Capacity)
+	fmt.Printf("hits:%d misses:%d evictions:%d\n", stats.Hits, stats.Misses, stats.Evictions)
+}
+
+// scan : list the keys from start up to but not including end through a client, up to the
+// last key if end is empty. Option prefix=P lists the keys starting with P instead. With
+// option limit=N the keys are listed in pages of N, each fetched with the token of the last
+func scan(clientId int64, start, end string, options ...string) {
+	arg := ScanData{Start: start, End: end, Prefix: option(options, "prefix")}
+	if arg.Prefix != "" {
+		fmt.Printf("Scanning keys starting with %s through Client[%d]\n", arg.Prefix, clientId)
+	} else {
+		fmt.Printf("Scanning [%s, %s) through Client[%d]\n", start, end, clientId)
+	}
+	client, ok := clients[clientId]
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	if limit := option(options, "limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			fmt.Printf("Invalid limit %s\n", limit)
+			return
+		}
+		arg.Limit = n
+	}
+
+	for page := 1; ; page++ {
+		var reply ScanResult
+		err := client.Call("ClientService.Scan", &arg, &reply)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		fmt.Printf("Page %d, served by server(s) %v\n", page, reply.Servers)
+		for _, e := range reply.Entries {
+			fmt.Printf("%s:%s\t%s\n", e.Key, e.Val, e.Clock)
+		}
+		if reply.Token == "" {
+			return
+		}
+		fmt.Printf("Next page at %s\n", reply.Token)
+		arg.Token = reply.Token
+	}
+}
+
+// watch : watch a key through a client, or every key that starts with P with option
+// prefix=P. The changes are printed in the background as they come, until unwatch
+func watch(clientId int64, key string, options ...string) {
+	client, ok := clients[clientId]
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	arg := WatchData{Key: key, Prefix: option(options, "prefix")}
+	var watchId int64
+	if err := client.Call("ClientService.Watch", &arg, &watchId); err != nil {
+		fmt.Printf("Error watching\t%v\n", err)
+		return
+	}
+	if arg.Prefix != "" {
+		fmt.Printf("Watch[%d] of Client[%d] on keys starting with %s\n", watchId, clientId, arg.Prefix)
+	} else {
+		fmt.Printf("Watch[%d] of Client[%d] on key %s\n", watchId, clientId, key)
+	}
+
+	go func() {
+		poll := WatchPoll{ID: watchId, Wait: 2 * time.Second}
+		for {
+			var reply WatchNotes
+			if err := client.Call("ClientService.PollWatch", &poll, &reply); err != nil {
+				fmt.Printf("Watch[%d] of Client[%d] ended\n", watchId, clientId)
+				return
+			}
+			for _, n := range reply.Notes {
+				if n.Deleted {
+					fmt.Printf("Watch[%d] %s deleted\t%s (%s on server[%d])\n", watchId, n.Key, n.Clock, n.Cause, n.Server)
+				} else {
+					fmt.Printf("Watch[%d] %s:%s\t%s (%s on server[%d])\n", watchId, n.Key, n.Val, n.Clock, n.Cause, n.Server)
+				}
+			}
+			if reply.Lost != 0 {
+				fmt.Printf("Watch[%d] lost %d notification(s)\n", watchId, reply.Lost)
+			}
+		}
+	}()
+}
+
+// unwatch : stop a watch of a client
+func unwatch(clientId, watchId int64) {
+	client, ok := clients[clientId]
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	var dummy int64
+	if err := client.Call("ClientService.Unwatch", &watchId, &dummy); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// put : put key:value through a client. Option w=LEVEL sets the consistency level of the
+// write: ONE, QUORUM, ALL or a number of servers. Option ttl=DURATION (like 30s or 5m) sets
+// the time to live of the value
+func put(clientId int64, key, value string, options ...string) {
 	fmt.Printf("Client[%d] putting %s:%s\n", clientId, key, value)
 	client, ok := clients[clientId]
 
@@ -257,18 +585,88 @@ func put(clientId int64, key, value string) {
 	var arg PutData
 	arg.Key = key
 	arg.Value = value
-	var reply int64
-	err := client.Call("ClientService.Put", &arg, &reply)
+	arg.W = option(options, "w")
+	ttl, err := ttlOption(options)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	arg.TTL = ttl
+	var reply RequestReply
+	err = client.Call("ClientService.Put", &arg, &reply)
 
 	if err != nil {
 		fmt.Printf("Error putting\t%v\n", err)
 	} else {
 		fmt.Printf("Successfully put %s:%s\n", key, value)
+		fmt.Printf("Served by server(s) %v\n", reply.Servers)
+	}
+
+}
+
+// putBatch : put many key:value pairs through a client as one atomic batch, under one
+// timestamp. Options w=LEVEL and ttl=DURATION are the ones of put
+func putBatch(clientId int64, keys, values []string, options ...string) {
+	fmt.Printf("Client[%d] putting a batch of %d key(s)\n", clientId, len(keys))
+	client, ok := clients[clientId]
+
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	ttl, err := ttlOption(options)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
 	}
+	arg := BatchData{Keys: keys, Values: values, W: option(options, "w"), TTL: ttl}
+	var reply RequestReply
+	err = client.Call("ClientService.PutBatch", &arg, &reply)
 
+	if err != nil {
+		fmt.Printf("Error putting batch\t%v\n", err)
+	} else {
+		for i := range keys {
+			fmt.Printf("Successfully put %s:%s\n", keys[i], values[i])
+		}
+		fmt.Printf("Served by server(s) %v\n", reply.Servers)
+	}
 }
 
-func get(clientId int64, key string) {
+// putIf : put key:value through a client only if the key is still at the version the client
+// last read or wrote. Options w=LEVEL and ttl=DURATION are the ones of put
+func putIf(clientId int64, key, value string, options ...string) {
+	fmt.Printf("Client[%d] conditionally putting %s:%s\n", clientId, key, value)
+	client, ok := clients[clientId]
+
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	ttl, err := ttlOption(options)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	arg := PutData{Key: key, Value: value, W: option(options, "w"), TTL: ttl}
+	var reply RequestReply
+	err = client.Call("ClientService.PutIf", &arg, &reply)
+
+	if err != nil && strings.HasPrefix(err.Error(), "ERR_CONFLICT") {
+		fmt.Printf("Conflict, %s was changed since Client[%d] read it\n%v\n", key, clientId, err)
+	} else if err != nil {
+		fmt.Printf("Error putting\t%v\n", err)
+	} else {
+		fmt.Printf("Successfully put %s:%s\n", key, value)
+		fmt.Printf("Served by server(s) %v\n", reply.Servers)
+	}
+}
+
+// get : get the value of key through a client. Option r=LEVEL sets the consistency level
+// of the read
+func get(clientId int64, key string, options ...string) {
 	fmt.Printf("Getting key %s from Client[%d]\n", key, clientId)
 
 	client, ok := clients[clientId]
@@ -277,21 +675,46 @@ func get(clientId int64, key string) {
 		return
 	}
 
-	var reply string
-	err := client.Call("ClientService.Get", &key, &reply)
+	arg := GetData{Key: key, R: option(options, "r")}
+	var reply RequestReply
+	err := client.Call("ClientService.Get", &arg, &reply)
 
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	} else {
-		fmt.Printf("Client[%d]\t%s:%s\n", clientId, key, reply)
+		fmt.Printf("Client[%d]\t%s:%s\n", clientId, key, reply.Val)
+		fmt.Printf("Served by server(s) %v\n", reply.Servers)
+	}
+}
+
+func del(clientId int64, key string) {
+	fmt.Printf("Client[%d] deleting %s\n", clientId, key)
+	client, ok := clients[clientId]
+
+	if !ok {
+		fmt.Printf("Client[%d] does not exist\n", clientId)
+		return
+	}
+
+	var reply RequestReply
+	err := client.Call("ClientService.Delete", &key, &reply)
+
+	if err != nil {
+		fmt.Printf("Error deleting\t%v\n", err)
+	} else {
+		fmt.Printf("Successfully deleted %s\n", key)
+		fmt.Printf("Served by server(s) %v\n", reply.Servers)
 	}
+
 }
 
-func stabilize() {
+// stabilize : stabilize every partition through its leader and print the report of each
+// round. With json=PATH the reports are also saved to PATH as a JSON array
+func stabilize(options ...string) {
 	fmt.Printf("Stablizing ...\n")
 
-	server := getRandomServer()
+	serverID, server := getRandomServer()
 
 	//server := servers[0]
 	if server == nil {
@@ -299,45 +722,165 @@ func stabilize() {
 		return
 	}
 
+	// Killed servers are no longer in servers and can't be part of any MST
 	serverList := make(map[int64]bool)
-	for serverID := range serverProcess {
-		serverList[serverID] = true
+	for k := range servers {
+		serverList[k] = true
 	}
 
+	failed := false
+	reports := make([]StabilizeReport, 0)
 	for len(serverList) != 0 {
+		// The leader elected by the partition of the server roots its MST
+		serverID, server = leaderOf(serverID, serverList)
+		fmt.Printf("Stabilizing through Server[%d]\n", serverID)
+
 		var arg int64
-		reply := make(map[int64]bool)
-		err := server.Call("ServerService.InitStabilize", &arg, &reply)
+		var reply StabilizeReport
+		var err error
 
-		if err != nil {
-			fmt.Println("Server RPC for Stabilize failed")
-			fmt.Println(err.Error())
+		for attempt := 0; attempt <= maxStabilizeRetries; attempt++ {
+			if attempt > 0 {
+				fmt.Printf("Retrying stabilize on Server[%d] (%d/%d)\n", serverID, attempt, maxStabilizeRetries)
+				time.Sleep(stabilizeRetryDelay)
+			}
+			reply = StabilizeReport{}
+			err = server.Call("ServerService.InitStabilize", &arg, &reply)
+
+			if err != nil {
+				fmt.Println("Server RPC for Stabilize failed")
+				fmt.Println(err.Error())
+			}
+			for k, v := range reply.Failed {
+				fmt.Printf("Server[%d] failed in round %d: %s\n", k, reply.Round, v)
+			}
+			if err == nil && len(reply.Failed) == 0 {
+				break
+			}
 		}
+		if err != nil || len(reply.Failed) != 0 {
+			failed = true
+		}
+
+		// Never pick the same root again, even if it could not stabilize
+		delete(serverList, serverID)
 
 		fmt.Println("List of servers in this MST: ")
-		for k := range reply {
+		for k := range reply.Servers {
 			fmt.Printf("%d\t", k)
 			delete(serverList, k)
 		}
 		fmt.Println()
+		if err == nil {
+			printReport(&reply)
+			reports = append(reports, reply)
+		}
 
 		for k, v := range servers {
 			if _, ok := serverList[k]; ok {
-				server = v
+				serverID, server = k, v
 			}
 		}
 	}
-	fmt.Println("Succeeded stabilizing")
+	if failed {
+		fmt.Println("Stabilizing finished with failed servers")
+	} else {
+		fmt.Println("Succeeded stabilizing")
+	}
 
+	if path := option(options, "json"); path != "" {
+		// Clocks are printed as <...>, keep them readable
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(reports)
+		if err == nil {
+			err = os.WriteFile(path, buf.Bytes(), 0666)
+		}
+		if err != nil {
+			fmt.Printf("Cannot save the round reports: %v\n", err)
+		} else {
+			fmt.Printf("Round reports saved to %s\n", path)
+		}
+	}
+}
+
+// printReport : print the tree, statistics and conflicts of a stabilize round
+func printReport(r *StabilizeReport) {
+	fmt.Printf("Round %d rooted at Server[%d]: gather %v, scatter %v, end %v, %d bytes\n",
+		r.Round, r.Root, r.GatherTime, r.ScatterTime, r.EndRoundTime, r.Bytes)
+
+	var walk func(server int64, depth int)
+	walk = func(server int64, depth int) {
+		n := r.Nodes[server]
+		fmt.Printf("%s Server[%d] gathered %d (%d B), scattered %d (%d B)\n",
+			strings.Repeat("  ", depth), server, n.Gathered, n.BytesUp, n.Scattered, n.BytesDown)
+		for _, child := range r.Tree[server] {
+			walk(child, depth+1)
+		}
+	}
+	walk(r.Root, 0)
+
+	for _, c := range r.Conflicts {
+		fmt.Printf("Conflict on %s at Server[%d]: kept %s over %s (%s)\n", c.Key, c.Server, c.Kept, c.Other, c.How)
+	}
 }
 
 /* *******************Helper Functions******************/
-// getRandomServer : get an rpc.Client handler of a random existing server
-func getRandomServer() *rpc.Client {
+
+// leaderOf : the leader elected by the partition of serverID. Falls back to serverID itself
+// when the leader is unknown or already stabilized in this call, the election may be behind
+// a change of the links
+func leaderOf(serverID int64, pending map[int64]bool) (int64, *rpc.Client) {
+	var leader int64
+	err := servers[serverID].Call("ServerService.Leader", &serverID, &leader)
+	if client, ok := servers[leader]; err == nil && ok && pending[leader] {
+		return leader, client
+	}
+	return serverID, servers[serverID]
+}
+
+// toFlags : turn master options (name or name=value) into command-line flags of a process
+func toFlags(options []string) []string {
+	flags := make([]string, 0, len(options))
+	for _, option := range options {
+		if option != "" {
+			flags = append(flags, "-"+option)
+		}
+	}
+	return flags
+}
+
+// option : value of the master option name=value, empty if it is not given
+func option(options []string, name string) string {
+	for _, o := range options {
+		if strings.HasPrefix(o, name+"=") {
+			return strings.TrimPrefix(o, name+"=")
+		}
+	}
+	return ""
+}
+
+// ttlOption : time to live given by the option ttl=DURATION, 0 if it is not given
+func ttlOption(options []string) (time.Duration, error) {
+	ttl := option(options, "ttl")
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid time to live %s", ttl)
+	}
+	return d, nil
+}
+
+// getRandomServer : get the id and rpc.Client handler of a random existing server
+func getRandomServer() (int64, *rpc.Client) {
 	length := len(servers)
 
 	if length == 0 {
-		return nil
+		return 0, nil
 	}
 
 	// Get a random position in the server set
@@ -345,16 +888,17 @@ func getRandomServer() *rpc.Client {
 	serverPos := r.Int63n(int64(length))
 	var server *rpc.Client
 	var i int64
+	var serverID int64
 	// A bit complex to get a random server
-	for _, server = range servers {
+	for serverID, server = range servers {
 		if i == serverPos {
 			break
 		} else {
 			i++
 		}
 	}
-	fmt.Printf("Chosen server is %d\n", serverPos)
-	return server
+	fmt.Printf("Chosen server is %d\n", serverID)
+	return serverID, server
 }
 
 // InvalidateClientCache : a test function to invalidate clients' caches from the master
@@ -459,15 +1003,15 @@ func AutomaticTest() {
 
 	// Initialize the test keys and values
 	for i := 0; i < NUMKEYS/2; i++ {
-		keys[i] = string('0' + i)
+		keys[i] = string(rune('0' + i))
 		keys[i+10] = "1" + keys[i]
 	}
 
 	for i := 0; i < NUMVALS; i++ {
 		if i < 26 {
-			values[i] = string('a' + i)
+			values[i] = string(rune('a' + i))
 		} else {
-			values[i] = string('A' + i - 26)
+			values[i] = string(rune('A' + i - 26))
 		}
 	}
 
@@ -996,15 +1540,15 @@ func PerformanceTestSingleServer() {
 
 	// Initialize the test keys and values
 	for i := 0; i < numReq/2; i++ {
-		keys[i] = string('0' + i)
+		keys[i] = string(rune('0' + i))
 		keys[i+10] = "1" + keys[i]
 	}
 
 	for i := 0; i < numReq; i++ {
 		if i < 26 {
-			values[i] = string('a' + i)
+			values[i] = string(rune('a' + i))
 		} else {
-			values[i] = string('A' + i - 26)
+			values[i] = string(rune('A' + i - 26))
 		}
 	}
 
@@ -1082,15 +1626,15 @@ func PerformanceTestSimple() {
 
 	// Initialize the test keys and values
 	for i := 0; i < numReq/2; i++ {
-		keys[i] = string('0' + i)
+		keys[i] = string(rune('0' + i))
 		keys[i+10] = "1" + keys[i]
 	}
 
 	for i := 0; i < numReq; i++ {
 		if i < 26 {
-			values[i] = string('a' + i)
+			values[i] = string(rune('a' + i))
 		} else {
-			values[i] = string('A' + i - 26)
+			values[i] = string(rune('A' + i - 26))
 		}
 	}
 
@@ -1164,7 +1708,7 @@ func main() {
 				goto InvalidInput
 			}
 
-			joinServer(id1)
+			joinServer(id1, elements[2:]...)
 
 		case "killServer":
 			if len(elements) < 2 {
@@ -1197,7 +1741,7 @@ func main() {
 				goto InvalidInput
 			}
 
-			joinClient(id1, id2)
+			joinClient(id1, id2, elements[3:]...)
 
 		case "breakConnection":
 			if len(elements) < 3 {
@@ -1240,7 +1784,18 @@ func main() {
 			createConnection(id1, id2)
 
 		case "stabilize":
-			stabilize()
+			stabilize(elements[1:]...)
+
+		case "links":
+			id1 = -1
+			if len(elements) >= 2 {
+				id1, err = strconv.ParseInt(elements[1], 10, 64)
+				if err != nil {
+					fmt.Printf("Can't parse %s to integer\n", elements[1])
+					goto InvalidInput
+				}
+			}
+			printLinks(id1)
 
 		case "printStore":
 			if len(elements) < 2 {
@@ -1255,6 +1810,79 @@ func main() {
 
 			printStore(id1)
 
+		case "cacheStats":
+			if len(elements) < 2 {
+				goto InvalidInput
+			}
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+
+			printCacheStats(id1)
+
+		case "watch":
+			if len(elements) < 3 {
+				goto InvalidInput
+			}
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+
+			if strings.HasPrefix(elements[2], "prefix=") {
+				watch(id1, "", elements[2:]...)
+			} else {
+				watch(id1, elements[2], elements[3:]...)
+			}
+
+		case "unwatch":
+			if len(elements) < 3 {
+				goto InvalidInput
+			}
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+			id2, err = strconv.ParseInt(elements[2], 10, 64)
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[2])
+				goto InvalidInput
+			}
+
+			unwatch(id1, id2)
+
+		case "scan":
+			if len(elements) < 3 {
+				goto InvalidInput
+			}
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+
+			// Positional start and end, then the options
+			var bounds, options []string
+			for _, e := range elements[2:] {
+				if strings.Contains(e, "=") {
+					options = append(options, e)
+				} else {
+					bounds = append(bounds, e)
+				}
+			}
+			if len(bounds) > 2 || (len(bounds) == 0 && option(options, "prefix") == "") {
+				goto InvalidInput
+			}
+			bounds = append(bounds, "", "")
+			scan(id1, bounds[0], bounds[1], options...)
+
 		case "put":
 			if len(elements) < 4 {
 				goto InvalidInput
@@ -1267,7 +1895,48 @@ func main() {
 				goto InvalidInput
 			}
 
-			put(id1, elements[2], elements[3])
+			put(id1, elements[2], elements[3], elements[4:]...)
+
+		case "putBatch":
+			if len(elements) < 4 {
+				goto InvalidInput
+			}
+
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+
+			// Key value pairs, then the options
+			var keys, values, options []string
+			for i := 2; i < len(elements); i++ {
+				if strings.HasPrefix(elements[i], "w=") || strings.HasPrefix(elements[i], "ttl=") {
+					options = append(options, elements[i])
+				} else if i+1 < len(elements) {
+					keys = append(keys, elements[i])
+					values = append(values, elements[i+1])
+					i++
+				} else {
+					goto InvalidInput
+				}
+			}
+			putBatch(id1, keys, values, options...)
+
+		case "putIf":
+			if len(elements) < 4 {
+				goto InvalidInput
+			}
+
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+
+			putIf(id1, elements[2], elements[3], elements[4:]...)
 
 		case "get":
 			if len(elements) < 3 {
@@ -1281,7 +1950,21 @@ func main() {
 				goto InvalidInput
 			}
 
-			get(id1, elements[2])
+			get(id1, elements[2], elements[3:]...)
+
+		case "delete":
+			if len(elements) < 3 {
+				goto InvalidInput
+			}
+
+			id1, err = strconv.ParseInt(elements[1], 10, 64)
+
+			if err != nil {
+				fmt.Printf("Can't parse %s to integer\n", elements[1])
+				goto InvalidInput
+			}
+
+			del(id1, elements[2])
 
 		case "exit":
 			return
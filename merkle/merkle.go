@@ -0,0 +1,109 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash/fnv"
+	"sort"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+)
+
+// Number of key ranges (leaves) of the tree. Must be a power of 2
+const Leaves = 64
+
+// Tree : Merkle tree over the key space of a data store. Keys are split into Leaves ranges
+// of their hash. A leaf is the hash of the entries in its range and an inner node is the
+// hash of its two children. Nodes are stored as a heap: the root is 0 and the children
+// of node i are 2i+1 and 2i+2
+type Tree struct {
+	Nodes [][]byte
+}
+
+// Bucket returns the leaf range that key belongs to
+func Bucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % Leaves)
+}
+
+// New builds the tree of a data store
+func New(data map[string]cache.Value) *Tree {
+	buckets := make([][]string, Leaves)
+	for k := range data {
+		b := Bucket(k)
+		buckets[b] = append(buckets[b], k)
+	}
+
+	t := &Tree{Nodes: make([][]byte, 2*Leaves-1)}
+	for b, keys := range buckets {
+		sort.Strings(keys)
+		h := sha1.New()
+		for _, k := range keys {
+			val := data[k]
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			for _, v := range val.Versions() {
+				h.Write([]byte(v.Val))
+				h.Write([]byte{0})
+				if v.Deleted {
+					h.Write([]byte{1})
+				}
+				h.Write([]byte(v.Clock.ToString()))
+				h.Write([]byte{0})
+			}
+		}
+		t.Nodes[Leaves-1+b] = h.Sum(nil)
+	}
+
+	for i := Leaves - 2; i >= 0; i-- {
+		h := sha1.New()
+		h.Write(t.Nodes[2*i+1])
+		h.Write(t.Nodes[2*i+2])
+		t.Nodes[i] = h.Sum(nil)
+	}
+	return t
+}
+
+// Diff returns the leaf ranges whose hashes differ between the two trees. Subtrees with
+// equal hashes are skipped, so equal stores are detected by comparing the roots only
+func (t *Tree) Diff(other *Tree) []int {
+	var out []int
+	if len(other.Nodes) != len(t.Nodes) {
+		for b := 0; b < Leaves; b++ {
+			out = append(out, b)
+		}
+		return out
+	}
+
+	var walk func(i int)
+	walk = func(i int) {
+		if bytes.Equal(t.Nodes[i], other.Nodes[i]) {
+			return
+		}
+		if i >= Leaves-1 {
+			out = append(out, i-(Leaves-1))
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return out
+}
+
+// Select returns the entries of data that fall in the given leaf ranges
+func Select(data map[string]cache.Value, buckets []int) map[string]cache.Value {
+	want := make(map[int]bool)
+	for _, b := range buckets {
+		want[b] = true
+	}
+
+	out := make(map[string]cache.Value)
+	for k, v := range data {
+		if want[Bucket(k)] {
+			out[k] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package merkle
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+func value(val string, owner, time int64) cache.Value {
+	return cache.Value{Val: val, Clock: vectorclock.VectorClock{Time: vectorclock.TimeStamp{Time: map[int64]int64{owner: time}}, Id: owner}}
+}
+
+func store() map[string]cache.Value {
+	return map[string]cache.Value{
+		"a": value("1", 10, 1),
+		"b": value("2", 10, 2),
+		"c": value("3", 11, 1),
+	}
+}
+
+func TestDiff(t *testing.T) {
+	deleted := value("", 10, 3)
+	deleted.Deleted = true
+
+	tests := []struct {
+		name   string
+		change func(m map[string]cache.Value)
+		want   []int
+	}{
+		{"equal stores", func(m map[string]cache.Value) {}, nil},
+		{"changed value", func(m map[string]cache.Value) { m["a"] = value("9", 10, 1) }, []int{Bucket("a")}},
+		{"newer clock", func(m map[string]cache.Value) { m["b"] = value("2", 10, 3) }, []int{Bucket("b")}},
+		{"missing key", func(m map[string]cache.Value) { delete(m, "c") }, []int{Bucket("c")}},
+		{"extra key", func(m map[string]cache.Value) { m["d"] = value("4", 11, 2) }, []int{Bucket("d")}},
+		{"tombstone", func(m map[string]cache.Value) { m["a"] = deleted }, []int{Bucket("a")}},
+	}
+	for _, tt := range tests {
+		other := store()
+		tt.change(other)
+		got := New(store()).Diff(New(other))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Diff = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffSortedAndSymmetric(t *testing.T) {
+	other := store()
+	for _, k := range []string{"x", "y", "z", "w"} {
+		other[k] = value(k, 12, 1)
+	}
+	a, b := New(store()), New(other)
+	ab, ba := a.Diff(b), b.Diff(a)
+	if !reflect.DeepEqual(ab, ba) {
+		t.Errorf("Diff is not symmetric: %v and %v", ab, ba)
+	}
+	for i := 1; i < len(ab); i++ {
+		if ab[i-1] >= ab[i] {
+			t.Errorf("Diff is not in ascending order: %v", ab)
+		}
+	}
+}
+
+func TestDiffOtherShape(t *testing.T) {
+	got := New(store()).Diff(&Tree{})
+	if len(got) != Leaves {
+		t.Errorf("Diff with an empty tree returned %d ranges, want %d", len(got), Leaves)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	m := store()
+	got := Select(m, []int{Bucket("a")})
+	if _, ok := got["a"]; !ok {
+		t.Errorf("Select dropped a: %v", got)
+	}
+	for k := range got {
+		if Bucket(k) != Bucket("a") {
+			t.Errorf("Select returned %s from range %d", k, Bucket(k))
+		}
+	}
+	if got := Select(m, nil); len(got) != 0 {
+		t.Errorf("Select with no range returned %v", got)
+	}
+}
@@ -0,0 +1,90 @@
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Number of points each server owns on the ring. More points spread the keys more evenly
+const VirtualNodes = 32
+
+type point struct {
+	hash   uint32
+	server int64
+}
+
+// Ring : consistent-hash ring of servers. A key is stored by the first N distinct servers
+// found walking clockwise from the hash of the key, its preference list
+type Ring struct {
+	points  []point
+	servers []int64
+}
+
+// hash places a key or a virtual node on the ring. MD5 spreads short, similar keys far
+// better than FNV does
+func hash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// New builds the ring of a set of servers
+func New(servers []int64) *Ring {
+	r := new(Ring)
+	r.servers = append(r.servers, servers...)
+	sort.Slice(r.servers, func(i, j int) bool { return r.servers[i] < r.servers[j] })
+
+	for _, s := range r.servers {
+		for v := 0; v < VirtualNodes; v++ {
+			r.points = append(r.points, point{hash(strconv.FormatInt(s, 10) + "#" + strconv.Itoa(v)), s})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].server < r.points[j].server
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// Servers returns the servers on the ring in ascending order
+func (r *Ring) Servers() []int64 {
+	return r.servers
+}
+
+// Preference returns the n servers that store key, in the order a request should try them.
+// If n is not positive or there are fewer than n servers, every server stores the key
+func (r *Ring) Preference(key string, n int) []int64 {
+	if len(r.points) == 0 {
+		return nil
+	}
+	if n <= 0 || n > len(r.servers) {
+		n = len(r.servers)
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	out := make([]int64, 0, n)
+	seen := make(map[int64]bool)
+	for i := 0; len(out) < n && i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.server] {
+			seen[p.server] = true
+			out = append(out, p.server)
+		}
+	}
+	return out
+}
+
+// Owns returns true if server is in the preference list of key
+func (r *Ring) Owns(server int64, key string, n int) bool {
+	for _, s := range r.Preference(key, n) {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package ring
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPreference(t *testing.T) {
+	r := New([]int64{3, 1, 2, 4})
+	tests := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{"one replica", 1, 1},
+		{"some replicas", 3, 3},
+		{"every server", 4, 4},
+		{"more replicas than servers", 6, 4},
+		{"no replication factor", 0, 4},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			key := "key" + strconv.Itoa(i)
+			got := r.Preference(key, tt.n)
+			if len(got) != tt.want {
+				t.Fatalf("%s: Preference(%s) = %v, want %d servers", tt.name, key, got, tt.want)
+			}
+			seen := make(map[int64]bool)
+			for _, s := range got {
+				if seen[s] {
+					t.Fatalf("%s: Preference(%s) = %v lists a server twice", tt.name, key, got)
+				}
+				seen[s] = true
+			}
+		}
+	}
+}
+
+func TestPreferenceEmptyRing(t *testing.T) {
+	if got := New(nil).Preference("a", 2); got != nil {
+		t.Errorf("Preference on an empty ring = %v, want nil", got)
+	}
+}
+
+func TestPreferenceIsAPrefix(t *testing.T) {
+	r := New([]int64{1, 2, 3, 4, 5})
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		all := r.Preference(key, 5)
+		for n := 1; n < 5; n++ {
+			got := r.Preference(key, n)
+			for j := range got {
+				if got[j] != all[j] {
+					t.Fatalf("Preference(%s, %d) = %v, not a prefix of %v", key, n, got, all)
+				}
+			}
+		}
+	}
+}
+
+func TestSameRingOnEveryProcess(t *testing.T) {
+	a, b := New([]int64{1, 2, 3}), New([]int64{3, 1, 2})
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		pa, pb := a.Preference(key, 2), b.Preference(key, 2)
+		if pa[0] != pb[0] || pa[1] != pb[1] {
+			t.Fatalf("Preference(%s) = %v and %v depending on the order of the servers", key, pa, pb)
+		}
+	}
+}
+
+func TestOwns(t *testing.T) {
+	r := New([]int64{1, 2, 3, 4})
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners := make(map[int64]bool)
+		for _, s := range r.Preference(key, 2) {
+			owners[s] = true
+		}
+		for _, s := range []int64{1, 2, 3, 4, 5} {
+			if got := r.Owns(s, key, 2); got != owners[s] {
+				t.Errorf("Owns(%d, %s) = %t, want %t", s, key, got, owners[s])
+			}
+		}
+	}
+}
+
+// Removing a server only moves the keys it was a replica of
+func TestRemoveMovesOnlyItsKeys(t *testing.T) {
+	before, after := New([]int64{1, 2, 3, 4}), New([]int64{1, 2, 3})
+	moved := 0
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		if before.Owns(4, key, 2) {
+			moved++
+			continue
+		}
+		b, a := before.Preference(key, 2), after.Preference(key, 2)
+		if b[0] != a[0] || b[1] != a[1] {
+			t.Errorf("Preference(%s) moved from %v to %v without server 4", key, b, a)
+		}
+	}
+	if moved == 0 {
+		t.Errorf("server 4 is a replica of none of 200 keys")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/merkle"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Time between two anti-entropy exchanges with a random neighbour, 0 to never run them. An
+// exchange gives up on the neighbour after antiEntropyTimeout
+var antiEntropyInterval time.Duration
+
+const antiEntropyTimeout = 5 * time.Second
+
+// AntiEntropyPayload : RPC type for exchanging the entries of the key ranges that differ
+type AntiEntropyPayload struct {
+	From    int64
+	Buckets []int
+	Data    map[string]cache.Value
+	Clock   vectorclock.VectorClock
+}
+
+// MerkleTree : RPC to get the Merkle tree of the keys both this server and the caller are
+// replicas of
+func (ss *ServerService) MerkleTree(arg *int64, reply *merkle.Tree) error {
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	*reply = *merkle.New(sharedWith(*arg))
+	return nil
+}
+
+// SyncBuckets : RPC to merge the entries the caller has in the given key ranges and
+// reply with the resulting entries of those ranges
+func (ss *ServerService) SyncBuckets(arg *AntiEntropyPayload, reply *AntiEntropyPayload) error {
+	debug(id, fmt.Sprintf("Syncing %d key range(s) ...", len(arg.Buckets)))
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	vClock.Update(&arg.Clock)
+	mergeEntries(arg.Data)
+
+	reply.From = id
+	reply.Buckets = arg.Buckets
+	reply.Data = merkle.Select(sharedWith(arg.From), arg.Buckets)
+	reply.Clock = vClock.Copy()
+	return nil
+}
+
+// mergeEntries applies the entries that are newer than the ones in the data store. They
+// also go to the cache so that the next stabilize spreads them. Caller holds lockCache
+func mergeEntries(entries map[string]cache.Value) {
+	for k, v := range entries {
+		if !ownsKey(id, k) {
+			continue
+		}
+		applied(&v)
+		v, changed := data.Merge(k, v, resolve)
+		if !changed {
+			continue
+		}
+		sCache.Merge(k, v, resolve)
+		appendLog(&walRecord{Op: "put", Key: k, Value: v, Clock: vClock, Version: versionNumber})
+		notifyWatchers(k, v, "anti-entropy")
+		debug(id, fmt.Sprintf("Anti-entropy updated %s:%s", k, v.Val))
+	}
+}
+
+// antiEntropy periodically compares the Merkle tree of the data store with a random
+// neighbour and exchanges the entries of the key ranges that differ
+func antiEntropy() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		time.Sleep(antiEntropyInterval)
+
+		peers := neighbours()
+		if len(peers) == 0 {
+			continue
+		}
+		ids := make([]int64, 0, len(peers))
+		for peerID := range peers {
+			ids = append(ids, peerID)
+		}
+		peerID := ids[r.Intn(len(ids))]
+		peer := peers[peerID]
+
+		var peerTree merkle.Tree
+		if err := callTimeout(peer, "ServerService.MerkleTree", &id, &peerTree, antiEntropyTimeout); err != nil {
+			debug(id, fmt.Sprintf("Anti-entropy with %d failed: %v", peerID, err))
+			continue
+		}
+
+		lockCache.Lock()
+		shared := sharedWith(peerID)
+		buckets := merkle.New(shared).Diff(&peerTree)
+		if len(buckets) == 0 {
+			lockCache.Unlock()
+			continue
+		}
+		arg := AntiEntropyPayload{From: id, Buckets: buckets, Data: merkle.Select(shared, buckets), Clock: vClock.Copy()}
+		lockCache.Unlock()
+
+		debug(id, fmt.Sprintf("Anti-entropy with %d: %d key range(s) differ", peerID, len(buckets)))
+		var reply AntiEntropyPayload
+		if err := callTimeout(peer, "ServerService.SyncBuckets", &arg, &reply, antiEntropyTimeout); err != nil {
+			debug(id, fmt.Sprintf("Anti-entropy with %d failed: %v", peerID, err))
+			continue
+		}
+
+		lockCache.Lock()
+		vClock.Update(&reply.Clock)
+		mergeEntries(reply.Data)
+		lockCache.Unlock()
+	}
+}
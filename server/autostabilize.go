@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Time between two stabilize rounds the servers start on their own, 0 to only stabilize
+// when master asks for it
+var stabilizeInterval time.Duration
+
+// autoStabilize starts a stabilize round every stabilizeInterval, at the beginning of each
+// slot of stabilizeInterval, when this server is the elected leader of its partition. Each
+// partition has one leader, so a single round is started in each partition per slot. A slot
+// whose round is still running when it begins is skipped: InitStabilize refuses to start a
+// round on a server already in one, and the loop itself waits for its round to end
+func autoStabilize() {
+	for {
+		now := time.Now()
+		next := now.Truncate(stabilizeInterval).Add(stabilizeInterval)
+		time.Sleep(next.Sub(now))
+
+		slot := next.UnixNano() / int64(stabilizeInterval)
+		if currentLeader() != id {
+			continue
+		}
+
+		debug(id, fmt.Sprintf("Automatic stabilize of slot %d ...", slot))
+		var arg int64
+		var report StabilizeReport
+		if err := new(ServerService).InitStabilize(&arg, &report); err != nil {
+			debug(id, fmt.Sprintf("Automatic stabilize failed: %v", err))
+			continue
+		}
+		debug(id, fmt.Sprintf("Automatic stabilize of round %d reached %d server(s), %d failed", report.Round, len(report.Servers), len(report.Failed)))
+	}
+}
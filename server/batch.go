@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// BatchArgs : RPC type for a batch of writes. Every value has Clock, the one timestamp of
+// the batch
+type BatchArgs struct {
+	Values map[string]cache.Value
+	Clock  vectorclock.VectorClock
+	Deps   vectorclock.VectorClock // session dependencies, like for a Put
+}
+
+// PutBatch RPC to apply a batch of writes of a client atomically: Get, Scan, PrintStore and
+// stabilize see all of them or none. A value of the batch is ordered against the other
+// versions of its key like a Put; all of them have the same clock, so the batch as a whole
+// is ordered before or after each concurrent write, on every server
+func (ss *ServerService) PutBatch(arg *BatchArgs, serverResp *cache.Payload) error {
+	debug(id, fmt.Sprintf("Starting batch of %d write(s) at %s ...", len(arg.Values), arg.Clock.ToString()))
+
+	if err := awaitDeps(&arg.Deps); err != nil {
+		return err
+	}
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	vClock.Update(&arg.Clock)
+	tick()
+	serverResp.Clock = vClock.Copy()
+	serverResp.Version = versionNumber
+	serverResp.Stable = stableClock.Copy()
+
+	changed := applyBatch(arg.Values)
+	appendLog(&walRecord{Op: "batch", Data: arg.Values, Clock: vClock, Version: versionNumber})
+	for k, v := range changed {
+		notifyWatchers(k, v, "batch")
+	}
+	return nil
+}
+
+// applyBatch merges the values of a batch into the data store and the cache, and returns
+// the ones that changed the data store. Caller holds lockCache
+func applyBatch(values map[string]cache.Value) map[string]cache.Value {
+	changed := make(map[string]cache.Value)
+	for k, v := range values {
+		merged, ok := data.Merge(k, v, resolve)
+		applied(&v)
+		if !ok {
+			debug(id, fmt.Sprintf("Batch write of %s not applied, current Clock: %s", k, merged.Clock.ToString()))
+			continue
+		}
+		sCache.Merge(k, merged, resolve)
+		changed[k] = merged
+	}
+	return changed
+}
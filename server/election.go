@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The leader announces itself again every electionInterval. A server that heard no
+// announcement for electionSilence elects a new leader, the leader may have died without its
+// links being broken. An election gives up on a neighbour after electionTimeout
+const electionInterval = 5 * time.Second
+const electionSilence = 3 * electionInterval
+const electionTimeout = 5 * time.Second
+
+// ElectArgs : RPC type for the flood of an election through the links between servers.
+// Visited holds the servers the flood reached so far. Leader and Epoch are only set in the
+// announcement of the result
+type ElectArgs struct {
+	Leader   int64
+	Epoch    int64
+	Visited  map[int64]bool
+	Deadline int64
+}
+
+// ElectReply : RPC type for the servers the flood reached through a server
+type ElectReply struct {
+	Reached map[int64]bool
+}
+
+// The stabilize root of the partition of this server, and the epoch of the election that
+// chose it. Elections started later have greater epochs
+var lockLeader sync.Mutex
+var leader int64
+var leaderEpoch int64
+var lastAnnounce time.Time // when the leader was last announced to this server
+
+// A server runs one election at a time
+var lockElect sync.Mutex
+
+// Elect : RPC of the search phase of an election. Replies every server reachable through
+// this server that the flood had not visited yet, along with the visited ones
+func (ss *ServerService) Elect(arg *ElectArgs, reply *ElectReply) error {
+	reply.Reached = flood("ServerService.Elect", arg)
+	return nil
+}
+
+// Coordinator : RPC announcing the leader of an election. The announcement is kept unless
+// the server already heard of a later election, and passed on to the neighbours
+func (ss *ServerService) Coordinator(arg *ElectArgs, reply *ElectReply) error {
+	lockLeader.Lock()
+	if arg.Epoch < leaderEpoch {
+		lockLeader.Unlock()
+		debug(id, fmt.Sprintf("Ignoring leader Server[%d] of an older election", arg.Leader))
+		arg.Visited[id] = true
+		reply.Reached = arg.Visited
+		return nil
+	}
+	if leader != arg.Leader {
+		debug(id, fmt.Sprintf("Server[%d] is the new leader", arg.Leader))
+	}
+	leader, leaderEpoch = arg.Leader, arg.Epoch
+	lastAnnounce = time.Now()
+	lockLeader.Unlock()
+
+	reply.Reached = flood("ServerService.Coordinator", arg)
+	return nil
+}
+
+// Leader : RPC to get the leader of the partition of the server, the root of its stabilize rounds
+func (ss *ServerService) Leader(arg *int64, reply *int64) error {
+	*reply = currentLeader()
+	return nil
+}
+
+// currentLeader returns the leader of the partition of this server
+func currentLeader() int64 {
+	lockLeader.Lock()
+	defer lockLeader.Unlock()
+	return leader
+}
+
+// flood calls method on the neighbours the flood has not visited, one after the other, so
+// that each server of the partition is visited once. Returns the visited servers
+func flood(method string, arg *ElectArgs) map[int64]bool {
+	arg.Visited[id] = true
+	for k, server := range neighbours() {
+		if arg.Visited[k] {
+			continue
+		}
+		var reply ElectReply
+		if err := callTimeout(server, method, arg, &reply, untilDeadline(arg.Deadline)); err != nil {
+			debug(id, fmt.Sprintf("Election cannot reach server[%d]: %v", k, err))
+			continue
+		}
+		for s := range reply.Reached {
+			arg.Visited[s] = true
+		}
+	}
+	return arg.Visited
+}
+
+// elect runs a flood-max election: it finds the servers reachable from this server through
+// their links and announces the greatest id among them as the leader of the partition
+func elect() {
+	lockElect.Lock()
+	defer lockElect.Unlock()
+
+	epoch := time.Now().UnixNano()
+	search := ElectArgs{Visited: make(map[int64]bool), Deadline: time.Now().Add(electionTimeout).UnixNano()}
+	members := flood("ServerService.Elect", &search)
+
+	winner := id
+	for k := range members {
+		if k > winner {
+			winner = k
+		}
+	}
+	debug(id, fmt.Sprintf("Election among %d server(s) chose Server[%d]", len(members), winner))
+	announce(winner, epoch)
+}
+
+// announce floods the leader chosen by the election of epoch through the partition. Returns
+// the servers it reached
+func announce(winner, epoch int64) map[int64]bool {
+	arg := ElectArgs{Leader: winner, Epoch: epoch, Visited: make(map[int64]bool), Deadline: time.Now().Add(electionTimeout).UnixNano()}
+	var reply ElectReply
+	new(ServerService).Coordinator(&arg, &reply)
+	return reply.Reached
+}
+
+// electionLoop elects a leader when the server joins, then keeps the leader known without
+// every server flooding the partition: only the leader announces itself again, every
+// electionInterval. A leader whose announcement reaches a greater id elects again, the
+// partition grew without an election, and a server that stops hearing the leader elects
+// a new one
+func electionLoop() {
+	elect()
+	for {
+		time.Sleep(electionInterval)
+
+		lockLeader.Lock()
+		self, epoch := leader == id, leaderEpoch
+		silent := time.Since(lastAnnounce) > electionSilence
+		lockLeader.Unlock()
+
+		if self {
+			for s := range announce(id, epoch) {
+				if s > id {
+					debug(id, fmt.Sprintf("Server[%d] is in the partition, electing again", s))
+					elect()
+					break
+				}
+			}
+		} else if silent {
+			debug(id, "The leader was not announced for a while, electing again")
+			elect()
+		}
+	}
+}
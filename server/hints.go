@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// HintArgs : RPC type for a write a client could not deliver to server For
+type HintArgs struct {
+	For     int64
+	Payload cache.Payload
+}
+
+// Writes accepted on behalf of unreachable servers, by the id of the server they are for.
+// Hints are kept in memory and handed over when a link to that server is created
+var lockHints sync.Mutex
+var hints = make(map[int64][]cache.Payload)
+
+// PutHint : RPC to accept a write on behalf of an unreachable server. The write is applied
+// here too if this server is a replica of the key, and kept as a hint for the other server.
+// A hint for this server itself is a plain Put, refused if this server is not a replica
+func (ss *ServerService) PutHint(arg *HintArgs, serverResp *cache.Payload) error {
+	if arg.For == id {
+		if !ownsKey(id, arg.Payload.Key) {
+			return fmt.Errorf("%s: server %d is not a replica of %s", errNotReplica, id, arg.Payload.Key)
+		}
+		req := arg.Payload
+		return ss.Put(&req, serverResp)
+	}
+	debug(id, fmt.Sprintf("Keeping hint %s:%s for server[%d] ...", arg.Payload.Key, arg.Payload.Val, arg.For))
+
+	if ownsKey(id, arg.Payload.Key) {
+		req := arg.Payload
+		if err := ss.Put(&req, serverResp); err != nil {
+			return err
+		}
+	} else {
+		if err := awaitDeps(&arg.Payload.Deps); err != nil {
+			return err
+		}
+		lockCache.Lock()
+		vClock.Update(&arg.Payload.Clock)
+		serverResp.Clock = vClock.Copy()
+		serverResp.Version = versionNumber
+		serverResp.Stable = stableClock.Copy()
+		lockCache.Unlock()
+	}
+
+	// The session of the client was checked here, the hint is delivered without it
+	hint := arg.Payload
+	hint.Deps = vectorclock.VectorClock{}
+	lockHints.Lock()
+	hints[arg.For] = append(hints[arg.For], hint)
+	lockHints.Unlock()
+	return nil
+}
+
+// deliverHints sends the hints kept for server through the new link to it. Hints that
+// fail are kept for the next link
+func deliverHints(server int64, client *rpc.Client) {
+	lockHints.Lock()
+	pending := hints[server]
+	delete(hints, server)
+	lockHints.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	debug(id, fmt.Sprintf("Delivering %d hint(s) to server[%d] ...", len(pending), server))
+
+	var failed []cache.Payload
+	for i := range pending {
+		var reply cache.Payload
+		if err := client.Call("ServerService.Put", &pending[i], &reply); err != nil {
+			debug(id, fmt.Sprintf("Failed to deliver hint %s to server[%d]: %v", pending[i].Key, server, err))
+			failed = append(failed, pending[i])
+			continue
+		}
+		lockCache.Lock()
+		vClock.Update(&reply.Clock)
+		lockCache.Unlock()
+	}
+
+	if len(failed) != 0 {
+		lockHints.Lock()
+		hints[server] = append(failed, hints[server]...)
+		lockHints.Unlock()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strconv"
+
+	"github.com/huydoan2/eventual_consistency/link"
+)
+
+// Links of this server with the processes that dial it. Its connections to the other
+// servers are in RPCclients
+var links = link.NewTable()
+
+// dialServer connects to another server, which refuses if it cut this server off
+func dialServer(serverID int64) (*rpc.Client, error) {
+	serverPort := strconv.FormatInt(baseServerPort+serverID, 10)
+	return link.Dial("localhost:"+serverPort, link.Peer{Role: link.Server, ID: id})
+}
+
+// Links : RPC to list the links of the server, one per peer in ascending order of id
+func (ss *ServerService) Links(arg *int64, reply *[]link.Info) error {
+	table := links.Links()
+	lockClients.Lock()
+	for peer := range RPCclients {
+		if _, ok := table[peer]; !ok {
+			table[peer] = &link.Info{Peer: peer, Role: link.Server}
+		}
+		table[peer].Out = true
+	}
+	lockClients.Unlock()
+
+	lockMembers.Lock()
+	for peer, info := range table {
+		if info.Role == "" && members[peer] {
+			info.Role = link.Server
+		} else if info.Role == "" {
+			info.Role = link.Client
+		}
+	}
+	lockMembers.Unlock()
+
+	*reply = make([]link.Info, 0, len(table))
+	for _, info := range table {
+		*reply = append(*reply, *info)
+	}
+	sort.Slice(*reply, func(i, j int) bool { return (*reply)[i].Peer < (*reply)[j].Peer })
+	return nil
+}
+
+// AdmitClient : RPC to let a client connect again after its link was broken
+func (ss *ServerService) AdmitClient(clientID *int64, reply *int64) error {
+	debug(id, fmt.Sprintf("Client[%d] may connect again", *clientID))
+	links.Restore(*clientID)
+	return nil
+}
+
+// PeerLeft : RPC telling the server that another server was killed. Its connections are
+// closed without cutting it off, so that it can join again, and it leaves the ring
+func (ss *ServerService) PeerLeft(serverID *int64, reply *int64) error {
+	debug(id, fmt.Sprintf("Server[%d] left, closing its connections", *serverID))
+	links.Drop(*serverID)
+
+	lockClients.Lock()
+	if client, ok := RPCclients[*serverID]; ok {
+		client.Close()
+		delete(RPCclients, *serverID)
+	}
+	lockClients.Unlock()
+	removeMembers(*serverID)
+	go elect()
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/ring"
+)
+
+// Servers this server knows of, and the consistent-hash ring built over them. A server
+// stays on the ring when a link to it breaks, a partition does not move its keys. It leaves
+// the ring when it is killed
+var lockMembers sync.Mutex
+var members = make(map[int64]bool)
+var keyRing = ring.New(nil)
+
+// A server that does not answer a forwarded Get or a hand-off within forwardTimeout is skipped
+const forwardTimeout = 2 * time.Second
+
+// addMembers puts servers on the ring
+func addMembers(ids ...int64) {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+
+	changed := false
+	for _, s := range ids {
+		if !members[s] {
+			members[s] = true
+			changed = true
+		}
+	}
+	if changed {
+		rebuildRing()
+	}
+}
+
+// removeMembers takes servers off the ring
+func removeMembers(ids ...int64) {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+
+	changed := false
+	for _, s := range ids {
+		if s != id && members[s] {
+			delete(members, s)
+			changed = true
+		}
+	}
+	if changed {
+		rebuildRing()
+	}
+}
+
+// rebuildRing builds the ring over the members and hands the keys whose replicas changed
+// over to their new replicas. Caller holds lockMembers
+func rebuildRing() {
+	list := make([]int64, 0, len(members))
+	for s := range members {
+		list = append(list, s)
+	}
+	before := keyRing
+	keyRing = ring.New(list)
+	go handOff(before, keyRing)
+}
+
+// ownsKey returns true if server is one of the replicas of key. With no replication
+// factor every server is a replica of every key
+func ownsKey(server int64, key string) bool {
+	if replicas <= 0 {
+		return true
+	}
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+	return keyRing.Owns(server, key, replicas)
+}
+
+// ownedBy returns the entries of m that at least one of the servers is a replica of
+func ownedBy(m map[string]cache.Value, servers map[int64]bool) map[string]cache.Value {
+	if replicas <= 0 {
+		return m
+	}
+	out := make(map[string]cache.Value)
+	for k, v := range m {
+		for s := range servers {
+			if ownsKey(s, k) {
+				out[k] = v
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Members : RPC to get the servers on the ring of this server
+func (ss *ServerService) Members(arg *int64, reply *[]int64) error {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+
+	*reply = append([]int64(nil), keyRing.Servers()...)
+	return nil
+}
+
+// sharedWith returns a copy of the entries of the data store that both this server and peer
+// are replicas of
+func sharedWith(peer int64) map[string]cache.Value {
+	if replicas <= 0 {
+		return data.Snapshot()
+	}
+	out := make(map[string]cache.Value)
+	data.Range(func(k string, v cache.Value) bool {
+		if ownsKey(id, k) && ownsKey(peer, k) {
+			out[k] = v
+		}
+		return true
+	})
+	return out
+}
+
+// handOff moves the keys whose preference list gained servers when the ring changed from
+// before to after. Every new replica this server is connected to gets its keys through the
+// HandOff RPC, and the keys this server is no longer a replica of are dropped once a replica
+// took them. The keys of a new replica that cannot be reached are put in the cache, so that
+// the next stabilize round gets them to it
+func handOff(before, after *ring.Ring) {
+	if replicas <= 0 {
+		return
+	}
+
+	moves := make(map[int64]map[string]cache.Value)
+	data.Range(func(k string, v cache.Value) bool {
+		for _, s := range after.Preference(k, replicas) {
+			if s == id || before.Owns(s, k, replicas) {
+				continue
+			}
+			if moves[s] == nil {
+				moves[s] = make(map[string]cache.Value)
+			}
+			moves[s][k] = v
+		}
+		return true
+	})
+
+	peers := neighbours()
+	for s, entries := range moves {
+		var taken []string
+		err := fmt.Errorf("not connected")
+		if server, ok := peers[s]; ok {
+			err = callTimeout(server, "ServerService.HandOff", &entries, &taken, forwardTimeout)
+		}
+
+		lockCache.Lock()
+		if err != nil {
+			debug(id, fmt.Sprintf("Cannot hand %d key(s) off to server[%d], keeping them for stabilize: %v", len(entries), s, err))
+			for k, v := range entries {
+				sCache.Merge(k, v, resolve)
+			}
+		} else {
+			debug(id, fmt.Sprintf("Handed %d key(s) off to server[%d]", len(taken), s))
+			acked := make(map[string]cache.Value, len(taken))
+			for _, k := range taken {
+				acked[k] = entries[k]
+			}
+			dropForeign(acked)
+		}
+		lockCache.Unlock()
+	}
+}
+
+// HandOff : RPC taking the keys another server moves to this server after the ring changed.
+// Replies the keys this server is a replica of, the ones it stored
+func (ss *ServerService) HandOff(arg *map[string]cache.Value, reply *[]string) error {
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	for k, v := range *arg {
+		if !ownsKey(id, k) {
+			continue
+		}
+		applied(&v)
+		if merged, changed := data.Merge(k, v, resolve); changed {
+			sCache.Merge(k, merged, resolve)
+			appendLog(&walRecord{Op: "put", Key: k, Value: merged, Clock: vClock, Version: versionNumber})
+			notifyWatchers(k, merged, "handoff")
+		}
+		*reply = append(*reply, k)
+	}
+	debug(id, fmt.Sprintf("Took %d handed off key(s)", len(*reply)))
+	return nil
+}
+
+// dropForeign removes the keys this server is not a replica of, among the entries a replica
+// took, unless a newer version was written here since. The dropped entries are logged.
+// Caller holds lockCache
+func dropForeign(taken map[string]cache.Value) {
+	dropped := make(map[string]cache.Value)
+	for k, v := range taken {
+		if ownsKey(id, k) {
+			continue
+		}
+		ok := data.DeleteIf(k, func(cur cache.Value) bool {
+			_, changed := resolve(v, cur)
+			return !changed
+		})
+		if ok {
+			debug(id, fmt.Sprintf("Dropping %s, not a replica", k))
+			dropped[k] = v
+		}
+	}
+	if len(dropped) != 0 {
+		appendLog(&walRecord{Op: "drop", Data: dropped, Clock: vClock, Version: versionNumber})
+	}
+}
+
+// forwardGet serves a Get of a key this server is neither a replica of nor holds, through the
+// first replica of the key it is connected to. A missing key here does not mean the key does
+// not exist, so it fails with an ERR_NOT_REPLICA error when no replica answers
+func forwardGet(clientReq *cache.Payload, serverResp *cache.Payload) error {
+	lockMembers.Lock()
+	owners := keyRing.Preference(clientReq.Key, replicas)
+	lockMembers.Unlock()
+
+	peers := neighbours()
+	for _, s := range owners {
+		server, ok := peers[s]
+		if !ok {
+			continue
+		}
+		debug(id, fmt.Sprintf("Not a replica of %s, forwarding the get to server[%d]", clientReq.Key, s))
+		var resp cache.Payload
+		if err := callTimeout(server, "ServerService.Get", clientReq, &resp, forwardTimeout); err != nil {
+			debug(id, fmt.Sprintf("Forwarded get failed on server[%d]: %v", s, err))
+			continue
+		}
+
+		lockCache.Lock()
+		defer lockCache.Unlock()
+		vClock.Update(&resp.Clock)
+		tick()
+		*serverResp = resp
+		serverResp.Clock = vClock.Copy()
+		serverResp.Version = versionNumber
+		serverResp.Stable = stableClock.Copy()
+		return nil
+	}
+	return fmt.Errorf("%s: server %d is not a replica of %s and cannot reach one", errNotReplica, id, clientReq.Key)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// NodeStats : what a server of the MST sent and received in a stabilize round
+type NodeStats struct {
+	Gathered  int   // entries it replied to Gather, from its cache and its subtree
+	Scattered int   // entries its parent scattered to it
+	BytesUp   int64 // size of its Gather reply
+	BytesDown int64 // size of the Scatter call its parent made to it
+}
+
+// Conflict : concurrent versions of a key that met on a server during Gather. How is "id"
+// when the version with the greater clock id was kept, "siblings" when both were
+type Conflict struct {
+	Key    string
+	Server int64
+	Kept   string
+	Other  string
+	How    string
+}
+
+// orderGathered orders the entries a child gathered into the cache like Order and returns
+// the conflicts with the versions already in the cache. Caller holds lockCache
+func orderGathered(entries map[string]cache.Value) []Conflict {
+	met := make(map[string]cache.Value)
+	for k, v := range entries {
+		if cur, ok := sCache.Get(k); ok && cur.Clock.Time.Compare(&v.Clock.Time) == vectorclock.CONCURENT {
+			met[k] = cur
+		}
+	}
+	Order(&entries, false)
+
+	out := make([]Conflict, 0, len(met))
+	for k, cur := range met {
+		next := entries[k]
+		kept, _ := sCache.Get(k)
+		c := Conflict{Key: k, Server: id, How: "id"}
+		if siblingsMode {
+			c.How = "siblings"
+			c.Kept, c.Other = describe(cur), describe(next)
+		} else if kept.Clock.Equal(&cur.Clock) {
+			c.Kept, c.Other = describe(cur), describe(next)
+		} else {
+			c.Kept, c.Other = describe(next), describe(cur)
+		}
+		debug(id, fmt.Sprintf("Conflict on %s: kept %s over %s (%s)", k, c.Kept, c.Other, c.How))
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// describe returns the value and clock of a version, for a report
+func describe(v cache.Value) string {
+	if v.Deleted {
+		return "<deleted> " + v.Clock.ToString()
+	}
+	return v.Val + " " + v.Clock.ToString()
+}
+
+// byteCounter : io.Writer that only counts the bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	return len(p), nil
+}
+
+// Size of the type descriptions gob sends before the first value of a type, by type
+var typeOverhead sync.Map
+
+// wireSize returns the size of v encoded by gob like net/rpc does, without the type
+// descriptions that are only sent once per connection. v is encoded once
+func wireSize(v interface{}) int64 {
+	var counter byteCounter
+	if err := gob.NewEncoder(&counter).Encode(v); err != nil {
+		return 0
+	}
+	return counter.n - overhead(reflect.TypeOf(v))
+}
+
+// overhead returns the size of the type descriptions gob sends with a value of type t. They
+// only depend on the type, so they are measured once on the zero value: the first encoding
+// has them and the second does not
+func overhead(t reflect.Type) int64 {
+	if n, ok := typeOverhead.Load(t); ok {
+		return n.(int64)
+	}
+	elem := t
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	zero := reflect.New(elem).Interface()
+
+	var counter byteCounter
+	enc := gob.NewEncoder(&counter)
+	if err := enc.Encode(zero); err != nil {
+		return 0
+	}
+	first := counter.n
+	enc.Encode(zero)
+	n := first - (counter.n - first)
+	typeOverhead.Store(t, n)
+	return n
+}
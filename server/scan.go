@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// ScanArgs : RPC type for a range scan of the data store
+type ScanArgs struct {
+	Start, End string // keys from Start up to but not including End, no bound if End is empty
+	Limit      int    // number of live keys in a page, 0 for no limit
+	Clock      vectorclock.VectorClock
+	Deps       vectorclock.VectorClock // session dependencies, like for a Get
+}
+
+// ScanReply : RPC type for a page of a range scan. Entries are in ascending order of their
+// keys and hold tombstones too. Token is the key the next page starts at, empty after the
+// last page
+type ScanReply struct {
+	Entries []cache.Payload
+	Token   string
+	Clock   vectorclock.VectorClock
+	Version int64
+	Stable  vectorclock.VectorClock // see cache.Payload
+}
+
+// Scan RPC to list the keys of the data store in a range, with their values as seen by Get.
+// Tombstones are listed so that the client can tell a deleted key from a key it caches, but
+// only live keys count towards the limit
+func (ss *ServerService) Scan(arg *ScanArgs, reply *ScanReply) error {
+	debug(id, fmt.Sprintf("Starting scan [%s, %s) ...", arg.Start, arg.End))
+
+	if err := awaitDeps(&arg.Deps); err != nil {
+		return err
+	}
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	vClock.Update(&arg.Clock)
+	tick()
+	reply.Clock = vClock.Copy()
+	reply.Version = versionNumber
+	reply.Stable = stableClock.Copy()
+
+	live := 0
+	for _, k := range data.Keys(arg.Start, arg.End, 0) {
+		val, ok := data.Get(k)
+		if !ok {
+			continue
+		}
+		// Live as Get sees it: an expired value counts as the tombstone it becomes
+		entry := cache.Payload{Key: k}
+		valueResponse(&val, &entry)
+		if arg.Limit > 0 && live == arg.Limit && !entry.Deleted {
+			reply.Token = k
+			break
+		}
+		if !entry.Deleted {
+			live++
+		}
+		reply.Entries = append(reply.Entries, entry)
+	}
+
+	debug(id, fmt.Sprintf("Scan returns %d entries, next page at %q", len(reply.Entries), reply.Token))
+	return nil
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/huydoan2/eventual_consistency/cache"
 	"github.com/huydoan2/eventual_consistency/vectorclock"
@@ -20,22 +24,52 @@ const baseServerPort int64 = 5000
 const serverPortRange int64 = 10
 const LOGDIR = "log"
 
+// Error of a conditional put whose expected version of the key is not the stored one
+const errConflict = "ERR_CONFLICT"
+
+// Error of a Get sent to a server that is not a replica of the key and cannot reach one
+const errNotReplica = "ERR_NOT_REPLICA"
+
+// A stabilize round that has not ended after roundTimeout is abandoned. Every level of the
+// MST gives up on its children hopMargin before its parent does, so a parent always hears
+// which subtree failed
+const roundTimeout = 10 * time.Second
+const hopMargin = 200 * time.Millisecond
+
 // global variables and structures
 var id int64
 var idStr string
 var RPCclients = make(map[int64]*rpc.Client) //store client struct for each connection
+var lockClients sync.Mutex                   // protects RPCclients
 var RPCserver *rpc.Server
 
-var sCache *cache.Cache
-var data = make(map[string]cache.Value)
+var sCache *cache.Store     // writes since the last stabilize
+var data = cache.NewStore() // the data store
 
 var vClock vectorclock.VectorClock
 var lockInTree sync.Mutex
-var bIntree bool
+var treeRound int64      // stabilize round this server is in the MST of, 0 if none
+var treeJoined time.Time // when this server joined the MST of treeRound
+
+// lockCache guards vClock, appliedClock and versionNumber. It is also held across every
+// change that spans several keys or both stores, and by the reads that must not see one
+// half done: a Put goes to data, sCache and the log, a batch to all of its keys, a Scatter
+// orders the round into data and clears it from sCache, and Get, scan, printStore, Gather and
+// the Merkle trees read under it. The stores only make a single Merge atomic, so guarding
+// just the clocks would let a Get show part of a batch or a Gather take a cache that a
+// Scatter is clearing
 var lockCache sync.Mutex
-var listChild []*rpc.Client
+var listChild map[int64]*rpc.Client            // children in the MST of treeRound
+var childSubtree map[int64]map[int64]bool      // servers in the subtree of each child
+var childHeld map[int64]map[string]cache.Value // entries each child's subtree gathered
+var treeGathered map[string]cache.Value        // entries this server gathered in treeRound
+var treeResult map[string]cache.Value          // entries scattered in treeRound
 var versionNumber int64
 
+// Options given on the command line
+var siblingsMode bool // keep concurrent versions of a key instead of ordering them by id
+var replicas int      // number of servers that store a key, 0 for every server
+
 /*
 	RPC
 */
@@ -48,26 +82,87 @@ type StabilizePayload struct {
 	IsChild   bool
 	Data      map[string]cache.Value
 	ChildList map[int64]bool
+	Failed    map[int64]string // servers that could not be reached in the round, with the error
 	Clock     vectorclock.VectorClock
+	Round     int64
+	Deadline  int64                   // unix time in ns after which the sender stops waiting for this call
+	Members   map[int64]bool          // servers in the MST of the round
+	Applied   vectorclock.VectorClock // join of the applied clocks of the servers of the subtree
+	Tree      map[int64][]int64       // children of each server of the subtree, in Gather replies
+	Stats     map[int64]NodeStats     // Gather statistics of each server of the subtree
+	Conflicts []Conflict              // conflicts resolved in the subtree
+}
+
+// GatherArgs : RPC type for the Gather call of a stabilize round
+type GatherArgs struct {
+	Round    int64
+	Parent   int64
+	Deadline int64 // unix time in ns after which the parent stops waiting for the reply
+}
+
+// ScatterReply : RPC type for the reply of Scatter, the servers of the subtree that failed and
+// the Scatter statistics of the others
+type ScatterReply struct {
+	Failed map[int64]string
+	Stats  map[int64]NodeStats
+}
+
+// EndRoundArgs : RPC type for closing a stabilize round
+type EndRoundArgs struct {
+	Round      int64
+	Tombstones map[string]vectorclock.VectorClock
+	Applied    map[int64]bool // servers that applied the Scatter of the round
+}
+
+// StabilizeReport : RPC type for the reply of InitStabilize
+type StabilizeReport struct {
+	Round     int64
+	Root      int64
+	Servers   map[int64]bool      // servers in the MST that applied the round
+	Failed    map[int64]string    // servers whose subtree was lost, with the error
+	Tree      map[int64][]int64   // children of each server in the MST
+	Nodes     map[int64]NodeStats // entries and bytes each server sent and received
+	Conflicts []Conflict          // concurrent versions ordered in Gather
+	Bytes     int64               // bytes of every Gather reply and Scatter call of the round
+
+	// Time spent in each phase of the round
+	GatherTime   time.Duration
+	ScatterTime  time.Duration
+	EndRoundTime time.Duration
 }
 
 // GetVersionNumber : RPC to get the version number of the server
-//					: Reply with versionNumber
+//
+//	: Reply with versionNumber
 func (ss *ServerService) GetVersionNumber(serverID *int64, serverVersion *int64) error {
 	debug(id, "Checking server version number... ")
+	lockCache.Lock()
+	defer lockCache.Unlock()
 	*serverVersion = versionNumber
 	return nil
 }
 
 // BreakConnection : RPC to break connection between servers
-//					: Reply 0 if conn existed and closed, 1 if never existed
+//
+//	: Reply 0 if conn existed and closed, 1 if never existed
+//
+// The peer is cut off: its connections to this server are closed too and it cannot connect
+// again until CreateConnection. The peer may also be a client
 func (ss *ServerService) BreakConnection(serverID *int64, reply *int64) error {
 	debug(id, fmt.Sprintf("Breaking connection to Server[%d]...", *serverID))
 
+	closed := links.Cut(*serverID)
+
+	lockClients.Lock()
+	defer lockClients.Unlock()
 	if client, ok := RPCclients[*serverID]; ok {
 		client.Close()
 		debug(id, fmt.Sprintf("Connection to server[%d] is broken successfully", *serverID))
 		delete(RPCclients, *serverID)
+		go elect()
+		*reply = 0
+	} else if closed > 0 {
+		debug(id, fmt.Sprintf("Closed %d connection(s) from %d", closed, *serverID))
 		*reply = 0
 	} else {
 		debug(id, fmt.Sprintf("Tried to break connection to server[%d] but was already broken", *serverID))
@@ -77,27 +172,53 @@ func (ss *ServerService) BreakConnection(serverID *int64, reply *int64) error {
 }
 
 // CreateConnection : RPC to create connection between client and server with id
-//					: Reply 0 if conn existed and created, 1 if never existed
+//
+//	: Reply 0 if conn existed and created, 1 if never existed
+//
+// The peer may connect to this server again, and is asked to connect back if it can
 func (ss *ServerService) CreateConnection(serverID *int64, reply *int64) error {
 	debug(id, fmt.Sprintf("Creating connection to Server[%d]...", *serverID))
 
-	if _, ok := RPCclients[*serverID]; !ok {
-		serverPort := strconv.FormatInt(baseServerPort+(*serverID), 10)
-		client, err := rpc.Dial("tcp", "localhost:"+serverPort)
-		if err == nil {
-			RPCclients[*serverID] = client
-			debug(id, fmt.Sprintf("Finished joining server[%d] to server[%d]\n", id, *serverID))
-		} else {
-			debug(id, err.Error())
-			panic(err)
-		}
-		debug(id, fmt.Sprintf("Connection to server[%d] is created successfully", *serverID))
-		RPCclients[*serverID] = client
-		*reply = 0
-	} else {
+	links.Restore(*serverID)
+
+	lockClients.Lock()
+	_, ok := RPCclients[*serverID]
+	lockClients.Unlock()
+	if ok {
 		debug(id, fmt.Sprintf("Tried to create connection to server[%d] but was already created", *serverID))
 		*reply = 1
+		return nil
+	}
+
+	// Dialed without lockClients, the handshake may wait for a peer that does not answer
+	client, err := dialServer(*serverID)
+	if err != nil {
+		// The peer still has the link broken on its side until master restores it there
+		debug(id, fmt.Sprintf("Cannot connect to server[%d]: %v", *serverID, err))
+		return err
+	}
+	lockClients.Lock()
+	if _, ok := RPCclients[*serverID]; ok {
+		// The peer connected back meanwhile, its connection is kept
+		lockClients.Unlock()
+		client.Close()
+		debug(id, fmt.Sprintf("Connection to server[%d] was created meanwhile", *serverID))
+		*reply = 1
+		return nil
 	}
+	RPCclients[*serverID] = client
+	lockClients.Unlock()
+	debug(id, fmt.Sprintf("Connection to server[%d] is created successfully", *serverID))
+
+	addMembers(*serverID)
+	go deliverHints(*serverID, client)
+	go elect()
+
+	var dummy int64
+	if err := client.Call("ServerService.ConnectAsClient", &id, &dummy); err != nil {
+		debug(id, fmt.Sprintf("Server[%d] cannot connect back: %v", *serverID, err))
+	}
+	*reply = 0
 	return nil
 }
 
@@ -105,16 +226,23 @@ func (ss *ServerService) CreateConnection(serverID *int64, reply *int64) error {
 func (ss *ServerService) ConnectAsClient(targetID *int64, reply *int64) error {
 	debug(id, fmt.Sprintf("Connecting as client to Server[%d]...", *targetID))
 
-	targetPort := strconv.FormatInt(*targetID+baseServerPort, 10)
-	client, err := rpc.Dial("tcp", "localhost:"+targetPort)
+	client, err := dialServer(*targetID)
 	if err != nil {
 		// Cannot connect to the target server
-		errorMsg := fmt.Sprintf("Cannot connect to server %d", *targetID)
+		errorMsg := fmt.Sprintf("Cannot connect to server %d: %v", *targetID, err)
 		return errors.New(errorMsg)
 	}
 
 	// Sucessfully connected to the target server
+	lockClients.Lock()
+	if old, ok := RPCclients[*targetID]; ok {
+		old.Close()
+	}
 	RPCclients[*targetID] = client // store the client handler
+	addMembers(*targetID)
+	lockClients.Unlock()
+	go deliverHints(*targetID, client)
+	go elect()
 	*reply = 1
 	return nil
 }
@@ -123,10 +251,13 @@ func (ss *ServerService) ConnectAsClient(targetID *int64, reply *int64) error {
 func (ss *ServerService) Cleanup(targetID *int64, reply *int64) error {
 	debug(id, "Cleaning up before being terminated...")
 
+	lockClients.Lock()
 	for k, v := range RPCclients {
 		v.Close()
 		delete(RPCclients, k)
 	}
+	lockClients.Unlock()
+	closeLog()
 	debug(id, "Cleanup complete. Prepare to die")
 	logFileHandler.Close()
 	return nil
@@ -138,10 +269,32 @@ func (ss *ServerService) PrintStore(notUse *int64, reply *map[string]string) err
 	//ret := make(map[string]string)
 
 	debug(id, "Printing Store now")
-	for k, v := range data {
+	// Never show part of a batch
+	lockCache.Lock()
+	defer lockCache.Unlock()
+	now := time.Now().UnixNano()
+	data.Range(func(k string, v cache.Value) bool {
+		v, _ = v.Expire(now)
+		if len(v.Siblings) != 0 {
+			// Show the live versions of a key with siblings as [v1, v2, ...]
+			var vals []string
+			for _, sib := range v.Versions() {
+				if !sib.Deleted {
+					vals = append(vals, sib.Val)
+				}
+			}
+			if len(vals) != 0 {
+				(*reply)[k] = "[" + strings.Join(vals, ", ") + "]"
+			}
+			return true
+		}
+		if v.Deleted {
+			return true
+		}
 		(*reply)[k] = v.Val
 		debug(id, fmt.Sprintf("P %s: %s", k, (*reply)[k]))
-	}
+		return true
+	})
 	//reply = &ret
 
 	return nil
@@ -151,119 +304,349 @@ func (ss *ServerService) PrintStore(notUse *int64, reply *map[string]string) err
 func (ss *ServerService) Put(clientReq *cache.Payload, serverResp *cache.Payload) error {
 	debug(id, fmt.Sprintf("Starting put %s:%s ...", (*clientReq).Key, (*clientReq).Val))
 
+	if err := awaitDeps(&clientReq.Deps); err != nil {
+		return err
+	}
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	put(clientReq, serverResp)
+	return nil
+}
+
+// PutIf RPC to respond to a conditional Put request from the client. The write is applied
+// only if the stored version of the key is the one the client expects or an older one, a
+// missing key always matches. Otherwise it fails with an ERR_CONFLICT error
+func (ss *ServerService) PutIf(clientReq *cache.Payload, serverResp *cache.Payload) error {
+	debug(id, fmt.Sprintf("Starting conditional put %s:%s, expecting %s ...", clientReq.Key, clientReq.Val, clientReq.Expected.ToString()))
+
+	if err := awaitDeps(&clientReq.Deps); err != nil {
+		return err
+	}
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	if val, ok := data.Get(clientReq.Key); ok {
+		// A key with siblings matches a client that read all of them
+		current := val.Context()
+		if current.Time.Compare(&clientReq.Expected.Time) != vectorclock.LESS {
+			debug(id, fmt.Sprintf("Conditional put refused, current Clock: %s", current.ToString()))
+			return fmt.Errorf("%s: %s is at %s, expected %s", errConflict, clientReq.Key, current.ToString(), clientReq.Expected.ToString())
+		}
+	}
+
+	put(clientReq, serverResp)
+	return nil
+}
+
+// put applies a write of a client. Caller holds lockCache
+func put(clientReq *cache.Payload, serverResp *cache.Payload) {
 	vClock.Update(&clientReq.Clock)
-	vClock.Increment(id)
-	serverResp.Clock = vClock
+	tick()
+	serverResp.Clock = vClock.Copy()
+	serverResp.Version = versionNumber
+	serverResp.Stable = stableClock.Copy()
 	update := 0
 
 	debug(id, fmt.Sprintf("Client Clock: %s", clientReq.Clock.ToString()))
-	val, ok := data[clientReq.Key]
-	if ok {
-		currClock := val.Clock
-		cmp := currClock.Compare(&clientReq.Clock)
-		debug(id, fmt.Sprintf("Current Clock: %s", currClock.ToString()))
-		if cmp == vectorclock.LESS {
-			data[clientReq.Key] = cache.Value{Val: clientReq.Val, Clock: clientReq.Clock}
-			update = 1
-		} else {
-			debug(id, "Record not updated")
-			serverResp.Key = clientReq.Key
-			serverResp.Val = val.Val
-			serverResp.ValTime = val.Clock
-		}
-	} else {
-		data[clientReq.Key] = cache.Value{Val: clientReq.Val, Clock: clientReq.Clock}
+	newEntry := cache.Value{Val: clientReq.Val, Clock: versionClock(clientReq), Deleted: clientReq.Deleted, Expires: clientReq.Expires}
+	val, changed := data.Merge(clientReq.Key, newEntry, resolve)
+	applied(&newEntry)
+	if changed {
 		update = 1
+		serverResp.ValTime = newEntry.Clock
+	} else {
+		debug(id, fmt.Sprintf("Record not updated, current Clock: %s", val.Clock.ToString()))
+		serverResp.Key = clientReq.Key
+		serverResp.Val = val.Val
+		serverResp.ValTime = val.Clock
+		serverResp.Deleted = val.Deleted
+		serverResp.Expires = val.Expires
 	}
 
 	if update == 1 {
-		sCache.Insert(clientReq)
+		sCache.Merge(clientReq.Key, val, resolve)
+		appendLog(&walRecord{Op: "put", Key: clientReq.Key, Value: val, Clock: vClock, Version: versionNumber})
+		notifyWatchers(clientReq.Key, val, "put")
 		debug(id, "Record updated")
 		// temp := sCache.Data[clientReq.Key].Clock
 
 		// debug(id, fmt.Sprintf("sCache Clock: %s", temp.ToString()))
 	}
+}
 
+// versionClock returns the clock a write of a client is stored at. In siblings mode it is the
+// context the client read the key at plus a new entry of the client, so that the write only
+// replaces the siblings the client saw. Otherwise it is the clock of the client, which
+// orders the write after everything the client saw
+func versionClock(clientReq *cache.Payload) vectorclock.VectorClock {
+	if !siblingsMode {
+		return clientReq.Clock
+	}
+	clock := clientReq.Context.Copy()
+	clock.Id = clientReq.Clock.Id
+	if clock.Time.Time[clock.Id] < clientReq.Clock.Time.Time[clock.Id] {
+		clock.Time.Time[clock.Id] = clientReq.Clock.Time.Time[clock.Id]
+	}
+	return clock
+}
+
+// Repair RPC to take a newer version of a key that a client read from another replica.
+// Unlike Put the version keeps its own clock, it is merged like in a stabilize
+func (ss *ServerService) Repair(clientReq *cache.Payload, serverResp *cache.Payload) error {
+	debug(id, fmt.Sprintf("Starting repair %s:%s ...", clientReq.Key, clientReq.Val))
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
+	vClock.Update(&clientReq.Clock)
+	serverResp.Clock = vClock.Copy()
+
+	if !ownsKey(id, clientReq.Key) {
+		debug(id, "Not a replica of the key, repair ignored")
+		return nil
+	}
+
+	newEntry := cache.Value{Val: clientReq.Val, Clock: clientReq.ValTime, Deleted: clientReq.Deleted, Expires: clientReq.Expires}
+	val, changed := data.Merge(clientReq.Key, newEntry, resolve)
+	applied(&newEntry)
+	if !changed {
+		debug(id, "Record not repaired")
+		return nil
+	}
+	sCache.Merge(clientReq.Key, val, resolve)
+	appendLog(&walRecord{Op: "put", Key: clientReq.Key, Value: val, Clock: vClock, Version: versionNumber})
+	notifyWatchers(clientReq.Key, val, "repair")
+	debug(id, "Record repaired")
 	return nil
 }
 
+// Delete RPC to respond to a Delete request from the client. The key is not removed
+// but overwritten with a tombstone, which is ordered and stabilized like any other write
+func (ss *ServerService) Delete(clientReq *cache.Payload, serverResp *cache.Payload) error {
+	debug(id, fmt.Sprintf("Starting delete %s ...", clientReq.Key))
+
+	clientReq.Val = ""
+	clientReq.Deleted = true
+	return ss.Put(clientReq, serverResp)
+}
+
 // Get RPC respond to Get request from the client
 func (ss *ServerService) Get(clientReq *cache.Payload, serverResp *cache.Payload) error {
 	debug(id, "Starting get...")
 
+	if !ownsKey(id, clientReq.Key) {
+		if _, ok := data.Get(clientReq.Key); !ok {
+			return forwardGet(clientReq, serverResp)
+		}
+	}
+
+	if err := awaitDeps(&clientReq.Deps); err != nil {
+		return err
+	}
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+
 	// Clock Update
 	vClock.Update(&clientReq.Clock)
-	vClock.Increment(id)
-	serverResp.Clock = vClock
+	tick()
+	serverResp.Clock = vClock.Copy()
+	serverResp.Version = versionNumber
+	serverResp.Stable = stableClock.Copy()
 
 	// Probably want to check the sCache first. Remember to update the sCache if query from the DataStore
 
 	// Check if it exists in data. If not return ERR_KEY
-	val, ok := data[clientReq.Key]
+	val, ok := data.Get(clientReq.Key)
+	serverResp.Key = clientReq.Key
 	if ok {
-		serverResp.Key = clientReq.Key
-		serverResp.Val = val.Val
-		serverResp.ValTime = val.Clock
+		valueResponse(&val, serverResp)
 	} else {
-		serverResp.Key = clientReq.Key
 		serverResp.Val = "ERR_KEY"
 	}
 
 	return nil
 }
 
+// valueResponse fills a Get response with the stored value of a key. An expired value is
+// reported like a tombstone
+func valueResponse(stored *cache.Value, serverResp *cache.Payload) {
+	val, _ := stored.Expire(time.Now().UnixNano())
+	if len(val.Siblings) != 0 {
+		siblingResponse(&val, serverResp)
+	} else if val.Deleted {
+		// Tombstone: report ERR_KEY together with the time of the delete
+		serverResp.Val = "ERR_KEY"
+		serverResp.ValTime = val.Clock
+		serverResp.Deleted = true
+	} else {
+		serverResp.Val = val.Val
+		serverResp.ValTime = val.Clock
+		serverResp.Expires = val.Expires
+	}
+}
+
+// siblingResponse fills a Get response with the versions of a key that has siblings. The first
+// live version is the value, the other live ones are its siblings and the causal context is
+// the join of every version, tombstones included
+func siblingResponse(val *cache.Value, serverResp *cache.Payload) {
+	serverResp.Context = val.Context()
+	serverResp.ValTime = serverResp.Context
+
+	var live []cache.Value
+	for _, v := range val.Versions() {
+		if !v.Deleted {
+			live = append(live, v)
+		}
+	}
+	if len(live) == 0 {
+		serverResp.Val = "ERR_KEY"
+		serverResp.Deleted = true
+		return
+	}
+	serverResp.Val = live[0].Val
+	serverResp.Expires = live[0].Expires
+	serverResp.Siblings = live[1:]
+}
+
+// resolve returns the entry to keep for a key that has the two versions cur and next, and
+// whether it differs from cur. Concurrent versions are ordered by the id of their clocks,
+// unless the server keeps them all as siblings. Expired versions are ordered as the
+// tombstones they become, and an expired cur is always replaced by its tombstone
+func resolve(cur, next cache.Value) (cache.Value, bool) {
+	now := time.Now().UnixNano()
+	cur, expired := cur.Expire(now)
+	next, _ = next.Expire(now)
+
+	if siblingsMode {
+		merged := cache.MergeSiblings(cur, next)
+		return merged, expired || !merged.Equal(&cur)
+	}
+	merged, changed := cache.Newer(cur, next)
+	return merged, expired || changed
+}
+
 // Order : update sCache only when updateData is false, otherwise update both sCache and the DataStore
 func Order(otherData *map[string]cache.Value, updateData bool) error {
 	debug(id, "Ordering ...")
 	for k, v := range *otherData {
 		debug(id, fmt.Sprintf("Entry is %s: %s, %s", k, v.Val, v.Clock.ToString()))
-		if myEntry, ok := sCache.Data[k]; ok {
-			debug(id, fmt.Sprintf("Compare myEntry: %s, %s and newEntry: %s, %s", myEntry.Val, myEntry.Clock.ToString(), v.Val, v.Clock.ToString()))
-			if myEntry.Clock.Compare(&v.Clock) == vectorclock.LESS {
-				debug(id, "newEntry is Greater and will update")
-				sCache.Data[k] = v
-				debug(id, fmt.Sprintf("Update Cache on order: %s:%s", k, v.Val))
-
-			}
-		} else {
-			debug(id, fmt.Sprintf("Insert Cache on order: %s:%s", k, v.Val))
-			sCache.Data[k] = v
+		if merged, changed := sCache.Merge(k, v, resolve); changed {
+			debug(id, fmt.Sprintf("Update Cache on order: %s:%s", k, merged.Val))
 		}
 	}
 	if updateData {
-		for k, v := range sCache.Data {
-			data[k] = v
-			debug(id, fmt.Sprintf("Update DataStore on order: %s:%s", k, v.Val))
-		}
+		sCache.Range(func(k string, v cache.Value) bool {
+			if !ownsKey(id, k) {
+				return true
+			}
+			// Never go back to an older entry learned through anti-entropy
+			if merged, changed := data.Merge(k, v, resolve); changed {
+				debug(id, fmt.Sprintf("Update DataStore on order: %s:%s", k, merged.Val))
+				notifyWatchers(k, merged, "scatter")
+			}
+			return true
+		})
 	}
 	return nil
 }
 
+// appliedRound adds the round to appliedClock and stableClock: the result, and the writes
+// every server of the MST had applied when it was gathered. Caller holds lockCache
+func appliedRound(result map[string]cache.Value, roundApplied *vectorclock.VectorClock) {
+	for _, v := range result {
+		applied(&v)
+		ctx := v.Context()
+		stableClock.Update(&ctx)
+	}
+	appliedClock.Update(roundApplied)
+	stableClock.Update(roundApplied)
+}
+
+// clearScattered removes from the cache the entries this server gathered in a round. An entry
+// that changed since the Gather, through a write accepted while the round went on, stays for
+// the next round. Caller holds lockCache
+func clearScattered(gathered map[string]cache.Value) {
+	for k, v := range gathered {
+		sCache.DeleteIf(k, func(cur cache.Value) bool { return cur.Equal(&v) })
+	}
+}
+
+// orderRound orders the result of a round into the DataStore, for the keys this server is a
+// replica of. Caller holds lockCache
+func orderRound(result map[string]cache.Value) {
+	for k, v := range result {
+		if !ownsKey(id, k) {
+			continue
+		}
+		// Never go back to an older entry learned through anti-entropy
+		if merged, changed := data.Merge(k, v, resolve); changed {
+			debug(id, fmt.Sprintf("Update DataStore on order: %s:%s", k, merged.Val))
+			notifyWatchers(k, merged, "scatter")
+		}
+	}
+}
+
+// missing returns the entries of result that differ from the ones in held
+func missing(result map[string]cache.Value, held map[string]cache.Value) map[string]cache.Value {
+	out := make(map[string]cache.Value)
+	for k, v := range result {
+		if h, ok := held[k]; !ok || !h.Equal(&v) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
 // Gather RPC converge cast, form MST, gather cache data to the root node
-func (ss *ServerService) Gather(arg *int64, reply *StabilizePayload) error {
-	//var err error
-	// var lockCounter sync.Mutex
+func (ss *ServerService) Gather(arg *GatherArgs, reply *StabilizePayload) error {
 
 	lockInTree.Lock()
-	debug(id, fmt.Sprintf("%d is checking if it is parent", *arg))
-	if bIntree == true {
+	debug(id, fmt.Sprintf("%d is checking if it is parent in round %d", arg.Parent, arg.Round))
+	if treeRound != 0 && time.Since(treeJoined) > roundTimeout {
+		// The previous round never finished here, its parent gave up on this subtree
+		debug(id, fmt.Sprintf("Round %d expired, leaving its tree", treeRound))
+		treeRound = 0
+		listChild = nil
+		childSubtree = nil
+		childHeld = nil
+		treeGathered = nil
+		treeResult = nil
+	}
+	if treeRound != 0 {
 		reply.IsChild = false
-		debug(id, fmt.Sprintf("%d is not parent. Returning", *arg))
+		debug(id, fmt.Sprintf("%d is not parent. Returning", arg.Parent))
 		lockInTree.Unlock()
 		return nil
 	}
-	bIntree = true
+	treeRound = arg.Round
+	treeJoined = time.Now()
+	listChild = make(map[int64]*rpc.Client)
+	childSubtree = make(map[int64]map[int64]bool)
+	childHeld = make(map[int64]map[string]cache.Value)
+	treeGathered = nil
+	treeResult = nil
 	lockInTree.Unlock()
 
 	var wg sync.WaitGroup
+	var lockReply sync.Mutex
 
-	debug(id, fmt.Sprintf("Gathering... called by Server[%d]", *arg))
-	debug(id, fmt.Sprintf("Now call gather on %d servers", len(RPCclients)))
+	debug(id, fmt.Sprintf("Gathering... called by Server[%d]", arg.Parent))
+	peers := neighbours()
+	debug(id, fmt.Sprintf("Now call gather on %d servers", len(peers)))
 
 	reply.ChildList = make(map[int64]bool)
-
-	for server_id, server := range RPCclients {
-		if server_id == *arg {
+	reply.Failed = make(map[int64]string)
+	reply.Tree = make(map[int64][]int64)
+	reply.Stats = make(map[int64]NodeStats)
+	children := make([]int64, 0, len(peers))
+	childArg := GatherArgs{Round: arg.Round, Parent: id, Deadline: arg.Deadline - int64(hopMargin)}
+
+	for server_id, server := range peers {
+		if server_id == arg.Parent {
 			continue
 		}
 		wg.Add(1)
@@ -271,43 +654,59 @@ func (ss *ServerService) Gather(arg *int64, reply *StabilizePayload) error {
 
 			defer wg.Done()
 			var response StabilizePayload
-			response.Data = make(map[string]cache.Value)
-			response.ChildList = make(map[int64]bool)
-			response.IsChild = false
-			response.Clock = vClock
 
-			debug(id, fmt.Sprintf("Calling gather from %d on %d", *arg, server_id))
-			err := server.Call("ServerService.Gather", &id, &response)
+			debug(id, fmt.Sprintf("Calling gather from %d on %d", arg.Parent, server_id))
+			err := callTimeout(server, "ServerService.Gather", &childArg, &response, untilDeadline(childArg.Deadline))
 
 			debug(id, fmt.Sprintf("Returned from Gather on %d", server_id))
-			for k, v := range response.Data {
-				debug(id, fmt.Sprintf("%s: %s", k, v.Val))
-			}
-			debug(id, fmt.Sprintf("respond: %t", response.IsChild))
-
 			if err != nil {
 				debug(id, fmt.Sprintf("Error: %s", err.Error()))
+				lockReply.Lock()
+				reply.Failed[server_id] = err.Error()
+				lockReply.Unlock()
+				// The child may still be gathering, tell its subtree to leave the round
+				var dummyReply int64
+				go callTimeout(server, "ServerService.EndRound", &EndRoundArgs{Round: arg.Round}, &dummyReply, roundTimeout)
 				return
 			}
+			debug(id, fmt.Sprintf("respond: %t", response.IsChild))
 
 			if response.IsChild == true {
 				lockCache.Lock()
-				defer lockCache.Unlock()
 				vClock.Update(&response.Clock)
-				Order(&response.Data, false)
-				listChild = append(listChild, server)
+				conflicts := orderGathered(response.Data)
+				lockCache.Unlock()
 
-				// reply.ChildList = make(map[string]bool)
+				lockInTree.Lock()
+				listChild[server_id] = server
+				subtree := map[int64]bool{server_id: true}
+				for k := range response.ChildList {
+					subtree[k] = true
+				}
+				childSubtree[server_id] = subtree
+				childHeld[server_id] = response.Data
+				lockInTree.Unlock()
+
+				lockReply.Lock()
 				debug(id, fmt.Sprintf("Adding %d to childList", server_id))
-				// reply.ChildList[1] = true
 				reply.ChildList[server_id] = true
 				for k := range response.ChildList {
 					reply.ChildList[k] = true
-
 				}
-
-				//lockCache.Unlock()
-				debug(id, fmt.Sprintf("Append to childList"))
+				for k, v := range response.Failed {
+					reply.Failed[k] = v
+				}
+				children = append(children, server_id)
+				for k, v := range response.Tree {
+					reply.Tree[k] = v
+				}
+				for k, v := range response.Stats {
+					reply.Stats[k] = v
+				}
+				reply.Applied.Update(&response.Applied)
+				reply.Conflicts = append(reply.Conflicts, response.Conflicts...)
+				reply.Conflicts = append(reply.Conflicts, conflicts...)
+				lockReply.Unlock()
 			}
 
 			debug(id, fmt.Sprintf("Leaving goroutine for gather on %d", server_id))
@@ -321,17 +720,31 @@ func (ss *ServerService) Gather(arg *int64, reply *StabilizePayload) error {
 	debug(id, "Waiting to sync threads")
 	wg.Wait()
 
+	// A server that failed on one link may still have joined the tree through another
+	for k := range reply.ChildList {
+		delete(reply.Failed, k)
+	}
+
 	debug(id, "Copying cache ...")
+	lockCache.Lock()
 	reply.IsChild = true
-	reply.Data = sCache.Data
-	reply.Clock = vClock
-	//reply.Data = make(map[string]cache.Val)
-	//debug(id, fmt.Sprintf("Finished Copying and size of cache is %d ...", len(sCache.Data)))
-
-	debug(id, "Now printing cache ...")
-	for k, v := range sCache.Data {
-		debug(id, fmt.Sprintf("Cache %s: %s", k, v.Val))
+	reply.Round = arg.Round
+	reply.Data = sCache.Snapshot()
+	reply.Clock = vClock.Copy()
+	reply.Applied.Update(&appliedClock)
+	lockCache.Unlock()
+
+	// Scatter spreads and clears what this server sent up, not the cache at that time: a write
+	// accepted in between did not reach the parent and stays for the next round
+	lockInTree.Lock()
+	if treeRound == arg.Round {
+		treeGathered = reply.Data
 	}
+	lockInTree.Unlock()
+
+	sort.Slice(children, func(i, j int) bool { return children[i] < children[j] })
+	reply.Tree[id] = children
+	reply.Stats[id] = NodeStats{Gathered: len(reply.Data), BytesUp: wireSize(reply)}
 
 	debug(id, "Now printing reply ...")
 	for k, v := range reply.Data {
@@ -341,73 +754,295 @@ func (ss *ServerService) Gather(arg *int64, reply *StabilizePayload) error {
 }
 
 // Scatter : RPC broadcast data in cache and time
-func (ss *ServerService) Scatter(arg *StabilizePayload, reply *int64) error {
+func (ss *ServerService) Scatter(arg *StabilizePayload, reply *ScatterReply) error {
 
 	var wg sync.WaitGroup
+	var lockReply sync.Mutex
 
-	wg.Add(len(listChild))
+	// Only forward to the children of this round, the tree may be from an expired round
+	children := make(map[int64]*rpc.Client)
+	subtrees := make(map[int64]map[int64]bool)
+	held := make(map[int64]map[string]cache.Value)
+	var gathered map[string]cache.Value
+	lockInTree.Lock()
+	if treeRound == arg.Round {
+		for k, v := range listChild {
+			children[k] = v
+			subtrees[k] = childSubtree[k]
+			held[k] = childHeld[k]
+		}
+		gathered = treeGathered
+	}
+	lockInTree.Unlock()
 
-	for serverID, server := range listChild {
-		go func(server *rpc.Client, serverID int) {
+	// The parent only sent the entries this subtree was missing. The others are the ones this
+	// server gathered, so these merged with the ones sent are the whole result of the round
+	result := make(map[string]cache.Value, len(gathered)+len(arg.Data))
+	for k, v := range gathered {
+		result[k] = v
+	}
+	for k, v := range arg.Data {
+		result[k] = v
+	}
+
+	for s := range arg.Members {
+		addMembers(s)
+	}
+
+	reply.Failed = make(map[int64]string)
+	reply.Stats = make(map[int64]NodeStats)
+
+	wg.Add(len(children))
+
+	for serverID, server := range children {
+		// A subtree only needs the keys that one of its servers is a replica of, and that it
+		// did not already gather in the version of the result
+		childArg := *arg
+		childArg.Deadline = arg.Deadline - int64(hopMargin)
+		childArg.Data = ownedBy(missing(result, held[serverID]), subtrees[serverID])
+		debug(id, fmt.Sprintf("Scattering %d of %d entries to %d", len(childArg.Data), len(result), serverID))
+
+		go func(server *rpc.Client, serverID int64, childArg *StabilizePayload) {
 			defer wg.Done()
-			// debug(id, fmt.Sprintf("Scatter to %d from %d", server_id, arg))
-			var dummyReply int64
-			err := server.Call("ServerService.Scatter", arg, &dummyReply)
+			var response ScatterReply
+			err := callTimeout(server, "ServerService.Scatter", childArg, &response, untilDeadline(childArg.Deadline))
+			size := wireSize(childArg)
+
+			lockReply.Lock()
+			defer lockReply.Unlock()
 			if err != nil {
-				// debug(id, fmt.Sprintf("Scatter failed with %v", err))
+				debug(id, fmt.Sprintf("Scatter to %d failed with %v", serverID, err))
+				reply.Failed[serverID] = err.Error()
 				return
 			}
-		}(server, serverID)
+			for k, v := range response.Failed {
+				reply.Failed[k] = v
+			}
+			for k, v := range response.Stats {
+				reply.Stats[k] = v
+			}
+			reply.Stats[serverID] = NodeStats{Scattered: len(childArg.Data), BytesDown: size}
+		}(server, serverID, &childArg)
 	}
 
 	wg.Wait()
 
+	lockCache.Lock()
+	defer lockCache.Unlock()
 	vClock.Update(&arg.Clock)
 	debug(id, fmt.Sprintf("Synced server time: %s", vClock.ToString()))
-	Order(&arg.Data, true)
-	sCache.Invalidate()
-	*reply = 1
+	clearScattered(gathered)
+	orderRound(result)
+	appliedRound(result, &arg.Applied)
 
 	versionNumber++
+	appendLog(&walRecord{Op: "scatter", Data: result, Gathered: gathered, Clock: vClock, Applied: arg.Applied, Version: versionNumber})
+
+	// The keys this server is not a replica of are dropped in EndRound, once their replicas
+	// applied the round
+	lockInTree.Lock()
+	if treeRound == arg.Round {
+		treeResult = result
+	}
+	lockInTree.Unlock()
+
+	return nil
+}
+
+// EndRound : RPC to close a stabilize round. It resets the tree state of every server in the
+// MST and garbage-collects the tombstones that all of them have seen. A tombstone is removed
+// only if it is not newer than the one scattered by the root
+func (ss *ServerService) EndRound(arg *EndRoundArgs, reply *int64) error {
+	var wg sync.WaitGroup
 
+	children := make(map[int64]*rpc.Client)
+	var result map[string]cache.Value
+	lockInTree.Lock()
+	if treeRound == arg.Round {
+		children = listChild
+		result = treeResult
+		treeRound = 0
+		listChild = nil
+		childSubtree = nil
+		childHeld = nil
+		treeGathered = nil
+		treeResult = nil
+	}
+	lockInTree.Unlock()
+
+	wg.Add(len(children))
+	for serverID, server := range children {
+		go func(server *rpc.Client, serverID int64) {
+			defer wg.Done()
+			var dummyReply int64
+			err := callTimeout(server, "ServerService.EndRound", arg, &dummyReply, roundTimeout)
+			if err != nil {
+				debug(id, fmt.Sprintf("EndRound on %d failed with %v", serverID, err))
+			}
+		}(server, serverID)
+	}
+	wg.Wait()
+
+	lockCache.Lock()
+	defer lockCache.Unlock()
+	purged := purgeTombstones(arg.Tombstones)
+	if len(purged) != 0 {
+		appendLog(&walRecord{Op: "purge", Data: purged, Clock: vClock, Version: versionNumber})
+	}
+	// A key this server is not a replica of was only kept until a replica received it
+	dropForeign(ownedBy(result, arg.Applied))
+	*reply = 1
 	return nil
 }
 
-// InitStabilize starts the Stabilize algorithm. This server is the root of the MST
-func (ss *ServerService) InitStabilize(arg *int64, reply *map[int64]bool) error {
-	debug(id, "Start stabilizing as root ...")
+// purgeTombstones removes the tombstones of the keys that are not newer than the given
+// clocks. Returns the purged tombstones. Caller holds lockCache
+func purgeTombstones(tombstones map[string]vectorclock.VectorClock) map[string]cache.Value {
+	purged := make(map[string]cache.Value)
+	for k, clock := range tombstones {
+		ok := data.DeleteIf(k, func(v cache.Value) bool {
+			return v.Deleted && len(v.Siblings) == 0 && v.Clock.Compare(&clock) == vectorclock.LESS
+		})
+		if ok {
+			debug(id, fmt.Sprintf("Purged tombstone %s", k))
+			purged[k] = cache.Value{Clock: clock, Deleted: true}
+		}
+	}
+	return purged
+}
+
+// InitStabilize starts the Stabilize algorithm. This server is the root of the MST.
+// The reply lists the servers in the MST and the servers whose subtree failed
+func (ss *ServerService) InitStabilize(arg *int64, reply *StabilizeReport) error {
+	lockInTree.Lock()
+	busy := treeRound != 0 && time.Since(treeJoined) <= roundTimeout
+	lockInTree.Unlock()
+	if busy {
+		return errors.New("a stabilize round is already in progress on this server")
+	}
+
+	round := newRound()
+	debug(id, fmt.Sprintf("Start stabilizing round %d as root ...", round))
 	var response StabilizePayload
-	response.Data = make(map[string]cache.Value)
-	response.ChildList = make(map[int64]bool)
-	response.IsChild = false
-	//bIntree = true
 	debug(id, "Beginning gather ...")
-	errGather := ss.Gather(&id, &response)
+	start := time.Now()
+	gatherArg := GatherArgs{Round: round, Parent: id, Deadline: time.Now().Add(roundTimeout).UnixNano()}
+	errGather := ss.Gather(&gatherArg, &response)
+	reply.GatherTime = time.Since(start)
 	debug(id, "Gather complete ...")
 	if errGather != nil {
 		debug(id, fmt.Sprintf("Gather failed with %v", errGather))
 		return errGather
 	}
+	if !response.IsChild {
+		// Another round took this server between the check and the gather
+		return errors.New("a stabilize round is already in progress on this server")
+	}
 
-	*reply = response.ChildList
-	(*reply)[id] = true
-
-	response.Data = sCache.Data
-	response.Clock = vClock
-	var dummyReply int64
+	reply.Round = round
+	reply.Root = id
+	reply.Servers = response.ChildList
+	reply.Servers[id] = true
+	reply.Failed = response.Failed
+	reply.Tree = response.Tree
+	reply.Nodes = response.Stats
+	reply.Conflicts = response.Conflicts
+
+	// The root's own Gather reply never went on the wire
+	root := reply.Nodes[id]
+	root.BytesUp = 0
+	reply.Nodes[id] = root
+	response.Tree, response.Stats, response.Conflicts = nil, nil, nil
+
+	response.Members = make(map[int64]bool)
+	for k := range reply.Servers {
+		response.Members[k] = true
+	}
+	response.Deadline = time.Now().Add(roundTimeout).UnixNano()
+	var scatterReply ScatterReply
 	debug(id, "Beginning scatter ...")
-	errScatter := ss.Scatter(&response, &dummyReply)
+	start = time.Now()
+	errScatter := ss.Scatter(&response, &scatterReply)
+	reply.ScatterTime = time.Since(start)
 	debug(id, "Scatter completed")
+	for k, v := range scatterReply.Failed {
+		reply.Failed[k] = v
+		delete(reply.Servers, k)
+	}
+	for k, v := range scatterReply.Stats {
+		node := reply.Nodes[k]
+		node.Scattered, node.BytesDown = v.Scattered, v.BytesDown
+		reply.Nodes[k] = node
+	}
+	for _, node := range reply.Nodes {
+		reply.Bytes += node.BytesUp + node.BytesDown
+	}
+
+	// Every server in the MST has applied the scattered tombstones, they can be dropped now.
+	// If a subtree failed, some servers may not have them and they are kept for another round
+	endArg := EndRoundArgs{Round: round, Tombstones: make(map[string]vectorclock.VectorClock), Applied: reply.Servers}
+	if errScatter == nil && len(reply.Failed) == 0 {
+		for k, v := range response.Data {
+			if v.Deleted {
+				endArg.Tombstones[k] = v.Clock
+			}
+		}
+	}
+	debug(id, fmt.Sprintf("Ending round %d, purging %d tombstone(s) ...", round, len(endArg.Tombstones)))
+	var dummyReply int64
+	start = time.Now()
+	ss.EndRound(&endArg, &dummyReply)
+	reply.EndRoundTime = time.Since(start)
+
 	if errScatter != nil {
 		debug(id, fmt.Sprintf("Scatter failed with %v", errScatter))
 		return errScatter
 	}
+	if len(reply.Failed) != 0 {
+		debug(id, fmt.Sprintf("Round %d finished with %d failed server(s)", round, len(reply.Failed)))
+	}
 
 	return nil
 }
 
 /*******************************************************/
 
+// neighbours returns a copy of the connections to the other servers
+func neighbours() map[int64]*rpc.Client {
+	lockClients.Lock()
+	defer lockClients.Unlock()
+
+	peers := make(map[int64]*rpc.Client, len(RPCclients))
+	for k, v := range RPCclients {
+		peers[k] = v
+	}
+	return peers
+}
+
+// newRound returns an id for a stabilize round started by this server
+func newRound() int64 {
+	return time.Now().UnixNano()/1000*1000 + id%1000
+}
+
+// untilDeadline returns the time left before a deadline given in unix ns
+func untilDeadline(deadline int64) time.Duration {
+	return time.Until(time.Unix(0, deadline))
+}
+
+// callTimeout calls an RPC and gives up after timeout
+func callTimeout(client *rpc.Client, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("%s: no time left in the round", method)
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return fmt.Errorf("%s: timed out after %v", method, timeout)
+	}
+}
+
 func connectToServers(serverList []int64) {
 	debug(id, "Connecting to other available servers ...")
 
@@ -416,12 +1051,13 @@ func connectToServers(serverList []int64) {
 		if serverId == id {
 			continue
 		}
-		targetPort := strconv.FormatInt(serverId+baseServerPort, 10)
-		client, err := rpc.Dial("tcp", "localhost:"+targetPort)
+		client, err := dialServer(serverId)
 		if err == nil {
 			// Succesffuly connected
-			debug(id, "Connected to "+targetPort)
+			debug(id, fmt.Sprintf("Connected to server[%d]", serverId))
+			lockClients.Lock()
 			RPCclients[serverId] = client // store the client handler
+			lockClients.Unlock()
 			// now call the rpc of the target server to connect to me
 			var reply int64
 			err = client.Call("ServerService.ConnectAsClient", &id, &reply)
@@ -481,9 +1117,20 @@ func Init(serverList []int64) {
 	vClock.Id = id
 
 	// Init cache
-	sCache = cache.New()
+	sCache = cache.NewStore()
+
+	treeRound = 0
+
+	// Alone until the first election
+	leader = id
 
-	bIntree = false
+	// Every server the master told us about is on the ring, reachable or not
+	addMembers(id)
+	addMembers(serverList...)
+
+	// Restore the store from the snapshot and write-ahead log of a previous run
+	recoverState()
+	openLog()
 
 	// Register RPC server
 	//RPCserver = rpc.NewServer()
@@ -497,12 +1144,22 @@ func Init(serverList []int64) {
 		panic(err)
 	}
 
-	// Need to check for correctness of the Accept(). Assume if the client hangs up, Accept() returns
-	go rpc.Accept(RPCserverConn)
+	// Every connection starts with a handshake naming the peer, see links.go
+	go links.Serve(RPCserverConn)
 
 	// Connect to other servers and ask them to connect to me
 	connectToServers(serverList)
 
+	// Converge with the neighbours in the background, between stabilize calls
+	if antiEntropyInterval > 0 {
+		go antiEntropy()
+	}
+	go expireLoop()
+	go electionLoop()
+	if stabilizeInterval > 0 {
+		go autoStabilize()
+	}
+
 	debug(id, "Initialization finished!\n")
 
 	// fmt.Printf("Connect to the master\n")
@@ -523,12 +1180,24 @@ func main() {
 	idStr = os.Args[1]
 
 	serverList := make([]int64, 0)
+	options := make([]string, 0)
 
 	for idx := 2; idx < len(os.Args); idx++ {
+		if strings.HasPrefix(os.Args[idx], "-") {
+			options = append(options, os.Args[idx])
+			continue
+		}
 		serverID, _ := strconv.ParseInt(os.Args[idx], 10, 64)
 		serverList = append(serverList, serverID)
 	}
 
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	flags.BoolVar(&siblingsMode, "siblings", false, "keep concurrent writes of a key as siblings")
+	flags.IntVar(&replicas, "replicas", 0, "number of servers that store a key, 0 for every server")
+	flags.DurationVar(&antiEntropyInterval, "antientropy", 0, "time between two anti-entropy exchanges, 0 for none")
+	flags.DurationVar(&stabilizeInterval, "stabilize", 0, "time between two stabilize rounds started by the servers, 0 for none")
+	flags.Parse(options)
+
 	Init(serverList)
 
 	defer logFileHandler.Close()
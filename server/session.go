@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// A request whose session dependencies the server has not seen waits up to sessionWait for
+// the server to catch up through anti-entropy or stabilize, then it is refused
+const sessionWait = time.Second
+const sessionPoll = 50 * time.Millisecond
+
+// Join of the clocks of the writes the data store applied: puts, batches, repairs, and the
+// versions a stabilize, anti-entropy or a hand-off merged. Unlike vClock a Get does not
+// advance it, so it only covers the writes the server has seen. Guarded by lockCache
+var appliedClock vectorclock.VectorClock
+
+// Join of the clocks of the writes the stabilize rounds of this server spread, and of the
+// ones every server of their MST had applied. A reply carries it with the version number so
+// the client knows which of its writes no longer need the cache. Guarded by lockCache
+var stableClock vectorclock.VectorClock
+
+// applied adds the clocks of a version and its siblings to appliedClock. Caller holds lockCache
+func applied(v *cache.Value) {
+	ctx := v.Context()
+	appliedClock.Update(&ctx)
+}
+
+// awaitDeps waits until the server applied the writes of deps, the session dependencies of
+// a client request: appliedClock dominates deps. It returns an error if that does not
+// happen within sessionWait. The clock of the server also counts the Gets it served and the
+// clocks of the clients, so it would let a request through before the writes arrived
+func awaitDeps(deps *vectorclock.VectorClock) error {
+	if len(deps.Time.Time) == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(sessionWait)
+	for {
+		lockCache.Lock()
+		seen := deps.Time.Compare(&appliedClock.Time) == vectorclock.LESS
+		clock := appliedClock.ToString()
+		lockCache.Unlock()
+
+		if seen {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			debug(id, fmt.Sprintf("Session dependencies %s not seen by %s, request refused", deps.ToString(), clock))
+			return fmt.Errorf("Server[%d] has not seen the session dependencies %s", id, deps.ToString())
+		}
+		time.Sleep(sessionPoll)
+	}
+}
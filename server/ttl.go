@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+)
+
+// Values whose time to live is over are turned into tombstones every expireInterval
+const expireInterval = time.Second
+
+// expireLoop turns the values of the data store whose time to live is over into tombstones.
+// Get, Scan and PrintStore already hide them; the tombstones also go to the cache, so the
+// next stabilize spreads them and then purges them from every data store
+func expireLoop() {
+	for {
+		time.Sleep(expireInterval)
+		lockCache.Lock()
+		expireEntries(time.Now().UnixNano())
+		lockCache.Unlock()
+	}
+}
+
+// expireEntries turns the values expired at now into tombstones. Caller holds lockCache
+func expireEntries(now int64) {
+	var expired []string
+	data.Range(func(k string, v cache.Value) bool {
+		if _, ok := v.Expire(now); ok {
+			expired = append(expired, k)
+		}
+		return true
+	})
+
+	for _, k := range expired {
+		v, ok := data.Get(k)
+		if !ok {
+			continue
+		}
+		// resolve replaces an expired value with its tombstone
+		v, changed := data.Merge(k, v, resolve)
+		if !changed {
+			continue
+		}
+		sCache.Merge(k, v, resolve)
+		appendLog(&walRecord{Op: "put", Key: k, Value: v, Clock: vClock, Version: versionNumber})
+		notifyWatchers(k, v, "expire")
+		debug(id, fmt.Sprintf("Expired %s", k))
+	}
+}
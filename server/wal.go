@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+	"github.com/huydoan2/eventual_consistency/vectorclock"
+)
+
+// Number of records appended to the write-ahead log before the store is snapshotted
+// and the log truncated
+const snapshotInterval = 100
+
+// The own entry of the clock is logged clockReserve ticks ahead of its value, so that the
+// ticks of Gets and of writes that changed nothing, which are not logged, are never used
+// again after a restart
+const clockReserve = 100
+
+// walRecord : one entry of the write-ahead log, a line of JSON in the log file
+//
+//	Op "put"     : Key was set to Value by an accepted Put/Delete
+//	Op "batch"   : the values of Data were written by an accepted PutBatch
+//	Op "scatter" : Data was ordered into the store by a Scatter, which set the version to Version
+//	               and removed the entries of Gathered from the cache
+//	Op "purge"   : the tombstones of Data were purged, unless newer than their clock
+//	Op "clock"   : the own entry of the clock is reserved up to Clock, see tick
+type walRecord struct {
+	Op       string
+	Key      string `json:",omitempty"`
+	Value    cache.Value
+	Data     map[string]cache.Value `json:",omitempty"`
+	Clock    vectorclock.VectorClock
+	Applied  vectorclock.VectorClock // appliedClock of the MST, in scatter records
+	Gathered map[string]cache.Value  `json:",omitempty"` // cache entries the round took, in scatter records
+	Version  int64
+}
+
+// snapshot : the whole state of the server at the time the log was truncated
+type snapshot struct {
+	Data    map[string]cache.Value
+	Cache   map[string]cache.Value
+	Clock   vectorclock.VectorClock
+	Applied vectorclock.VectorClock
+	Stable  vectorclock.VectorClock
+	Version int64
+}
+
+var walFile *os.File
+var walRecords int
+var lockWal sync.Mutex
+var clockReserved int64 // own entry of the clock reserved in the log
+
+func walPath() string {
+	return LOGDIR + "/server" + idStr + ".wal"
+}
+
+func snapshotPath() string {
+	return LOGDIR + "/server" + idStr + ".snapshot"
+}
+
+// openLog opens the write-ahead log for appending
+func openLog() {
+	var err error
+	walFile, err = os.OpenFile(walPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// closeLog closes the write-ahead log, used before the server is killed
+func closeLog() {
+	lockWal.Lock()
+	defer lockWal.Unlock()
+
+	if walFile != nil {
+		walFile.Close()
+		walFile = nil
+	}
+}
+
+// tick increments the own entry of the clock, and reserves more ticks in the log when it
+// reaches the reserved ones. Caller holds lockCache
+func tick() {
+	vClock.Increment(id)
+	if vClock.Time.Time[id] > clockReserved {
+		clockReserved = vClock.Time.Time[id] + clockReserve
+		appendLog(&walRecord{Op: "clock", Clock: reservedClock(), Version: versionNumber})
+	}
+}
+
+// reservedClock returns the clock with its own entry at the reserved value
+func reservedClock() vectorclock.VectorClock {
+	c := vClock.Copy()
+	if c.Time.Time[id] < clockReserved {
+		c.Time.Time[id] = clockReserved
+	}
+	return c
+}
+
+// appendLog writes rec to the write-ahead log and syncs it to disk. Every snapshotInterval
+// records the store is snapshotted and the log starts over
+func appendLog(rec *walRecord) {
+	lockWal.Lock()
+	defer lockWal.Unlock()
+
+	if walFile == nil {
+		return
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		debug(id, fmt.Sprintf("Cannot encode log record: %v", err))
+		return
+	}
+	line = append(line, '\n')
+	if _, err = walFile.Write(line); err != nil {
+		debug(id, fmt.Sprintf("Cannot append to log: %v", err))
+		return
+	}
+	walFile.Sync()
+
+	walRecords++
+	if walRecords >= snapshotInterval {
+		writeSnapshot()
+	}
+}
+
+// writeSnapshot saves the store, cache, clock and version number, then truncates the log.
+// The snapshot is written to a temporary file first so a crash never leaves a partial one
+func writeSnapshot() {
+	debug(id, "Writing snapshot ...")
+
+	snap := snapshot{Data: data.Snapshot(), Cache: sCache.Snapshot(), Clock: reservedClock(), Applied: appliedClock, Stable: stableClock, Version: versionNumber}
+	buf, err := json.Marshal(&snap)
+	if err != nil {
+		debug(id, fmt.Sprintf("Cannot encode snapshot: %v", err))
+		return
+	}
+
+	tmp := snapshotPath() + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0666); err != nil {
+		debug(id, fmt.Sprintf("Cannot write snapshot: %v", err))
+		return
+	}
+	if err = os.Rename(tmp, snapshotPath()); err != nil {
+		debug(id, fmt.Sprintf("Cannot install snapshot: %v", err))
+		return
+	}
+
+	if err = walFile.Truncate(0); err != nil {
+		debug(id, fmt.Sprintf("Cannot truncate log: %v", err))
+		return
+	}
+	walRecords = 0
+}
+
+// recoverState rebuilds the store from the last snapshot and the records logged after it
+func recoverState() {
+	if buf, err := os.ReadFile(snapshotPath()); err == nil {
+		var snap snapshot
+		if err = json.Unmarshal(buf, &snap); err != nil {
+			debug(id, fmt.Sprintf("Cannot decode snapshot: %v", err))
+		} else {
+			data.Load(snap.Data)
+			sCache.Load(snap.Cache)
+			vClock.Update(&snap.Clock)
+			appliedClock.Update(&snap.Applied)
+			stableClock.Update(&snap.Stable)
+			versionNumber = snap.Version
+			debug(id, fmt.Sprintf("Loaded snapshot with %d entries", data.Len()))
+		}
+	}
+
+	f, err := os.Open(walPath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn write at the end of the log, everything before it was applied
+			debug(id, fmt.Sprintf("Stopped replaying log: %v", err))
+			break
+		}
+
+		switch rec.Op {
+		case "put":
+			// Concurrent puts may be logged in another order than they were applied
+			data.Merge(rec.Key, rec.Value, resolve)
+			sCache.Merge(rec.Key, rec.Value, resolve)
+			applied(&rec.Value)
+		case "batch":
+			applyBatch(rec.Data)
+		case "scatter":
+			clearScattered(rec.Gathered)
+			orderRound(rec.Data)
+			appliedRound(rec.Data, &rec.Applied)
+			versionNumber = rec.Version
+		case "purge":
+			tombstones := make(map[string]vectorclock.VectorClock, len(rec.Data))
+			for k, v := range rec.Data {
+				tombstones[k] = v.Clock
+			}
+			purgeTombstones(tombstones)
+		case "drop":
+			for k := range rec.Data {
+				data.Delete(k)
+			}
+		}
+		vClock.Update(&rec.Clock)
+		walRecords++
+	}
+	// Ticks up to the reserved ones may have been used before the restart
+	clockReserved = vClock.Time.Time[id]
+	debug(id, fmt.Sprintf("Replayed %d log record(s), clock is %s", walRecords, vClock.ToString()))
+}
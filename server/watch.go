@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huydoan2/eventual_consistency/cache"
+)
+
+// A subscription keeps at most watchBuffer notifications that were not polled yet, older
+// ones are dropped. A subscription not polled for watchIdle is removed
+const watchBuffer = 1000
+const watchIdle = 30 * time.Second
+
+// A poll waits at most maxPollWait for a notification
+const maxPollWait = 10 * time.Second
+
+// WatchArgs : RPC type for a subscription to the changes of a key, or of every key that
+// starts with Prefix when it is set
+type WatchArgs struct {
+	Key    string
+	Prefix string
+}
+
+// WatchEvent : notification of a change of a key on this server. Cause is what changed it:
+// put, repair, scatter, anti-entropy or expire
+type WatchEvent struct {
+	Key    string
+	Value  cache.Value
+	Cause  string
+	Server int64
+}
+
+// PollArgs : RPC type for a poll of the notifications of a subscription
+type PollArgs struct {
+	ID   int64
+	Wait time.Duration // how long to wait for a notification if there is none
+}
+
+// PollReply : RPC type for the notifications of a subscription since the last poll. Lost is
+// the number of notifications dropped because the subscription was not polled in time
+type PollReply struct {
+	Events []WatchEvent
+	Lost   int
+}
+
+type subscription struct {
+	key, prefix string
+	events      []WatchEvent
+	lost        int
+	wake        chan struct{} // signaled when a notification arrives
+	polled      time.Time     // last time a poll started or ended
+}
+
+// Subscription registry, by subscription id
+var lockWatch sync.Mutex
+var watchers = make(map[int64]*subscription)
+var nextWatchID int64
+
+// Watch : RPC to subscribe to the changes of a key or prefix. Replies the id of the
+// subscription, whose notifications are read with PollWatch
+func (ss *ServerService) Watch(arg *WatchArgs, reply *int64) error {
+	lockWatch.Lock()
+	defer lockWatch.Unlock()
+
+	nextWatchID++
+	watchers[nextWatchID] = &subscription{key: arg.Key, prefix: arg.Prefix, wake: make(chan struct{}, 1), polled: time.Now()}
+	*reply = nextWatchID
+	debug(id, fmt.Sprintf("Subscription %d to key %q prefix %q", nextWatchID, arg.Key, arg.Prefix))
+	return nil
+}
+
+// PollWatch : RPC to read the notifications of a subscription. It waits up to arg.Wait for
+// one if there is none yet
+func (ss *ServerService) PollWatch(arg *PollArgs, reply *PollReply) error {
+	lockWatch.Lock()
+	sub, ok := watchers[arg.ID]
+	if !ok {
+		lockWatch.Unlock()
+		return fmt.Errorf("Server[%d] has no subscription %d", id, arg.ID)
+	}
+	sub.polled = time.Now()
+	if len(sub.events) == 0 && arg.Wait > 0 {
+		wait := arg.Wait
+		if wait > maxPollWait {
+			wait = maxPollWait
+		}
+		lockWatch.Unlock()
+		select {
+		case <-sub.wake:
+		case <-time.After(wait):
+		}
+		lockWatch.Lock()
+	}
+	reply.Events, reply.Lost = sub.events, sub.lost
+	sub.events, sub.lost = nil, 0
+	select {
+	case <-sub.wake:
+	default:
+	}
+	sub.polled = time.Now()
+	lockWatch.Unlock()
+	return nil
+}
+
+// Unwatch : RPC to remove a subscription
+func (ss *ServerService) Unwatch(subID *int64, reply *int64) error {
+	lockWatch.Lock()
+	defer lockWatch.Unlock()
+	delete(watchers, *subID)
+	debug(id, fmt.Sprintf("Subscription %d removed", *subID))
+	return nil
+}
+
+// notifyWatchers hands the new value of key to the subscriptions that match it. Subscriptions
+// no longer polled are removed on the way
+func notifyWatchers(key string, val cache.Value, cause string) {
+	lockWatch.Lock()
+	defer lockWatch.Unlock()
+
+	for subID, sub := range watchers {
+		if time.Since(sub.polled) > watchIdle {
+			debug(id, fmt.Sprintf("Subscription %d was not polled, removing it", subID))
+			delete(watchers, subID)
+			continue
+		}
+		if sub.prefix != "" && !strings.HasPrefix(key, sub.prefix) || sub.prefix == "" && key != sub.key {
+			continue
+		}
+		if len(sub.events) == watchBuffer {
+			sub.events = sub.events[1:]
+			sub.lost++
+		}
+		sub.events = append(sub.events, WatchEvent{Key: key, Value: val, Cause: cause, Server: id})
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -3,11 +3,9 @@ package vectorclock
 import (
 	"bytes"
 	"fmt"
-	"math"
+	"sort"
 )
 
-const MAXPROC = 10
-
 type Cmp int
 
 const (
@@ -16,43 +14,91 @@ const (
 	CONCURENT
 )
 
+// TimeStamp is a sparse vector of logical times keyed by process id.
+// A process without an entry is treated as having time 0
 type TimeStamp struct {
-	Time [MAXPROC]int64
+	Time map[int64]int64
 }
 
+// Compare returns GREATER if t dominates other, CONCURENT if neither dominates,
+// and LESS otherwise (equal timestamps compare as LESS)
 func (t *TimeStamp) Compare(other *TimeStamp) Cmp {
-	var count = 0
-	out := LESS
+	less, greater := false, false
 	for k, v := range t.Time {
-		if out == GREATER && other.Time[k] > v {
-			count++
-			out = LESS
-		} else if out == LESS && other.Time[k] < v {
-			count++
-			out = GREATER
+		if v > other.Time[k] {
+			greater = true
+		} else if v < other.Time[k] {
+			less = true
+		}
+	}
+	for k, v := range other.Time {
+		if _, ok := t.Time[k]; !ok && v > 0 {
+			less = true
 		}
+	}
+
+	if less && greater {
+		return CONCURENT
+	}
+	if greater {
+		return GREATER
+	}
+	return LESS
+}
 
-		if count == 2 {
-			out = CONCURENT
-			break
+// Equal returns true if both timestamps have the same time for every process
+func (t *TimeStamp) Equal(other *TimeStamp) bool {
+	for k, v := range t.Time {
+		if other.Time[k] != v {
+			return false
 		}
 	}
-	return out
+	for k, v := range other.Time {
+		if t.Time[k] != v {
+			return false
+		}
+	}
+	return true
 }
 
 func (t *TimeStamp) Increment(id int64) {
-	if id > 9 {
-		panic(fmt.Sprintf("VectorClock: id %d is out of range", id))
+	if t.Time == nil {
+		t.Time = make(map[int64]int64)
 	}
 	t.Time[id]++
 }
 
 func (t *TimeStamp) Update(other *TimeStamp) {
-	for k, _ := range t.Time {
-		t.Time[k] = int64(math.Max(float64(t.Time[k]), float64(other.Time[k])))
+	if t.Time == nil {
+		t.Time = make(map[int64]int64)
+	}
+	for k, v := range other.Time {
+		if v > t.Time[k] {
+			t.Time[k] = v
+		}
 	}
 }
 
+// Copy returns a deep copy of the timestamp. Timestamps share their map on
+// assignment, so copy before storing one that will keep being incremented
+func (t *TimeStamp) Copy() TimeStamp {
+	c := TimeStamp{Time: make(map[int64]int64, len(t.Time))}
+	for k, v := range t.Time {
+		c.Time[k] = v
+	}
+	return c
+}
+
+// ids returns the process ids with an entry in the timestamp, in ascending order
+func (t *TimeStamp) ids() []int64 {
+	ids := make([]int64, 0, len(t.Time))
+	for k := range t.Time {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
 type VectorClock struct {
 	Time TimeStamp
 	Id   int64
@@ -69,27 +115,42 @@ func (t *VectorClock) Compare(other *VectorClock) Cmp {
 	return out
 }
 
+// Equal returns true if both clocks have the same time and owner
+func (t *VectorClock) Equal(other *VectorClock) bool {
+	return t.Id == other.Id && t.Time.Equal(&other.Time)
+}
+
 func (t *VectorClock) Update(other *VectorClock) {
 	t.Time.Update(&other.Time)
 }
 
 func (t *VectorClock) Increment(id int64) {
-	if id > 9 {
-		panic(fmt.Sprintf("VectorClock: id %d is out of range", id))
-	}
 	t.Time.Increment(id)
 }
 
+// Copy returns a deep copy of the vector clock
+func (t *VectorClock) Copy() VectorClock {
+	return VectorClock{Time: t.Time.Copy(), Id: t.Id}
+}
+
+// ToString formats the clock as <<id:time, ...>, ownerId> listing only non-zero entries
 func (t *VectorClock) ToString() string {
 	var buffer bytes.Buffer
 	buffer.WriteString("<<")
 
-	i := 0
-	for ; i < MAXPROC-1; i++ {
-		buffer.WriteString(fmt.Sprintf("%d, ", t.Time.Time[i]))
+	first := true
+	for _, k := range t.Time.ids() {
+		if t.Time.Time[k] == 0 {
+			continue
+		}
+		if !first {
+			buffer.WriteString(", ")
+		}
+		first = false
+		buffer.WriteString(fmt.Sprintf("%d:%d", k, t.Time.Time[k]))
 	}
 
-	buffer.WriteString(fmt.Sprintf("%d>, ", t.Time.Time[i]))
+	buffer.WriteString(">, ")
 	buffer.WriteString(fmt.Sprintf("%d>", t.Id))
 
 	return buffer.String()
@@ -0,0 +1,105 @@
+package vectorclock
+
+import "testing"
+
+func ts(m map[int64]int64) TimeStamp {
+	return TimeStamp{Time: m}
+}
+
+func TestTimeStampCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b map[int64]int64
+		want Cmp
+	}{
+		{"both empty", nil, nil, LESS},
+		{"equal", map[int64]int64{1: 2, 3: 4}, map[int64]int64{1: 2, 3: 4}, LESS},
+		{"less", map[int64]int64{1: 1}, map[int64]int64{1: 2}, LESS},
+		{"greater", map[int64]int64{1: 3}, map[int64]int64{1: 2}, GREATER},
+		{"missing entry is zero", map[int64]int64{1: 1}, map[int64]int64{1: 1, 2: 1}, LESS},
+		{"extra entry dominates", map[int64]int64{1: 1, 2: 1}, map[int64]int64{1: 1}, GREATER},
+		{"zero entry equals missing", map[int64]int64{1: 1, 2: 0}, map[int64]int64{1: 1}, LESS},
+		{"missing equals zero entry", map[int64]int64{1: 1}, map[int64]int64{1: 1, 2: 0}, LESS},
+		{"concurrent", map[int64]int64{1: 2}, map[int64]int64{2: 1}, CONCURENT},
+		{"concurrent on shared ids", map[int64]int64{1: 2, 2: 1}, map[int64]int64{1: 1, 2: 2}, CONCURENT},
+	}
+	for _, tt := range tests {
+		a, b := ts(tt.a), ts(tt.b)
+		if got := a.Compare(&b); got != tt.want {
+			t.Errorf("%s: Compare = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimeStampEqual(t *testing.T) {
+	tests := []struct {
+		a, b map[int64]int64
+		want bool
+	}{
+		{nil, nil, true},
+		{map[int64]int64{1: 1}, map[int64]int64{1: 1}, true},
+		{map[int64]int64{1: 1, 2: 0}, map[int64]int64{1: 1}, true},
+		{map[int64]int64{1: 1}, map[int64]int64{1: 2}, false},
+		{map[int64]int64{1: 1}, map[int64]int64{1: 1, 2: 1}, false},
+	}
+	for _, tt := range tests {
+		a, b := ts(tt.a), ts(tt.b)
+		if got := a.Equal(&b); got != tt.want {
+			t.Errorf("%v Equal %v = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTimeStampUpdate(t *testing.T) {
+	tests := []struct {
+		a, b, want map[int64]int64
+	}{
+		{nil, map[int64]int64{1: 1}, map[int64]int64{1: 1}},
+		{map[int64]int64{1: 3}, map[int64]int64{1: 1, 2: 2}, map[int64]int64{1: 3, 2: 2}},
+		{map[int64]int64{1: 1}, nil, map[int64]int64{1: 1}},
+		{map[int64]int64{1: 1, 2: 5}, map[int64]int64{2: 4, 3: 0}, map[int64]int64{1: 1, 2: 5}},
+	}
+	for _, tt := range tests {
+		a, b, want := ts(tt.a), ts(tt.b), ts(tt.want)
+		a.Update(&b)
+		if !a.Equal(&want) {
+			t.Errorf("%v Update %v = %v, want %v", tt.a, tt.b, a.Time, tt.want)
+		}
+	}
+}
+
+func TestVectorClockCompareTieBreak(t *testing.T) {
+	a := VectorClock{Time: ts(map[int64]int64{1: 1}), Id: 1}
+	b := VectorClock{Time: ts(map[int64]int64{2: 1}), Id: 2}
+	if got := a.Compare(&b); got != LESS {
+		t.Errorf("lower id Compare = %v, want LESS", got)
+	}
+	if got := b.Compare(&a); got != GREATER {
+		t.Errorf("higher id Compare = %v, want GREATER", got)
+	}
+}
+
+func TestCopyIsDeep(t *testing.T) {
+	a := VectorClock{Time: ts(map[int64]int64{1: 1}), Id: 1}
+	c := a.Copy()
+	a.Increment(1)
+	if c.Time.Time[1] != 1 {
+		t.Errorf("copy changed with the original: %v", c.Time.Time)
+	}
+}
+
+func TestToString(t *testing.T) {
+	tests := []struct {
+		clock VectorClock
+		want  string
+	}{
+		{VectorClock{Id: 3}, "<<>, 3>"},
+		{VectorClock{Time: ts(map[int64]int64{2: 1, 1: 4}), Id: 1}, "<<1:4, 2:1>, 1>"},
+		{VectorClock{Time: ts(map[int64]int64{1: 0, 2: 1}), Id: 2}, "<<2:1>, 2>"},
+	}
+	for _, tt := range tests {
+		if got := tt.clock.ToString(); got != tt.want {
+			t.Errorf("ToString = %q, want %q", got, tt.want)
+		}
+	}
+}